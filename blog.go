@@ -0,0 +1,556 @@
+package notebrew
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+func (app *App) Blog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		app.Error(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/")
+	if segments[0] != "blog" || len(segments) > 4 || (len(segments) == 4 && segments[2] != "tag") {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	if len(segments) == 4 {
+		if r.Method != "GET" {
+			app.Error(w, r, http.StatusMethodNotAllowed, nil)
+			return
+		}
+		app.blogTag(w, r, segments[1], segments[3])
+		return
+	}
+	// Only saving the theme of a blog is a POST, every other page under
+	// the blog is a feed or a post.
+	if len(segments) == 3 && !(r.Method == "POST" && segments[2] == "theme") {
+		if r.Method != "GET" {
+			app.Error(w, r, http.StatusMethodNotAllowed, nil)
+			return
+		}
+		// Slugs have no dots in them, so they can't be mistaken for
+		// the feeds.
+		if segments[2] == "feed.xml" || segments[2] == "rss.xml" {
+			app.blogFeed(w, r, segments[1], segments[2])
+			return
+		}
+		app.blogPost(w, r, segments[1], segments[2])
+		return
+	}
+
+	// Blogs can be read by anyone, only editing them requires logging in.
+	if len(segments) == 2 && r.Method == "GET" && !r.URL.Query().Has("edit") && !r.URL.Query().Has("theme") && !r.URL.Query().Has("comments") {
+		app.blogIndex(w, r, segments[1])
+		return
+	}
+
+	currentUserID, loggedIn := app.CurrentUserID(r)
+	if !loggedIn {
+		app.Redirect(w, r, "/login", map[string]string{
+			"RedirectTo": r.URL.Path,
+		})
+		return
+	}
+
+	if len(segments) >= 2 {
+		blogID, err := ulid.Parse(segments[1])
+		if err != nil {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		blog, err := app.fetchBlog(r.Context(), blogID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				app.Error(w, r, http.StatusNotFound, nil)
+				return
+			}
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if blog.UserID != currentUserID {
+			app.Error(w, r, http.StatusForbidden, nil)
+			return
+		}
+		if len(segments) == 3 {
+			app.saveTheme(w, r, blog)
+			return
+		}
+		if r.Method == "GET" {
+			if r.URL.Query().Has("theme") {
+				app.themeEditor(w, r, http.StatusOK, blog, nil, nil)
+				return
+			}
+			if r.URL.Query().Has("comments") {
+				app.commentQueue(w, r, blog)
+				return
+			}
+			app.blogEditor(w, r, blog)
+			return
+		}
+		form, err := readBlogForm(r, app.appHost())
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, err)
+			return
+		}
+		// The blog editor is only served on the host of notebrew, which
+		// can't be the domain of a blog as well.
+		for _, domain := range form.Domains {
+			if domain == normalizeHost(r.Host) {
+				app.Error(w, r, http.StatusBadRequest, domain+" is the domain of notebrew itself")
+				return
+			}
+		}
+		err = app.updateBlog(r.Context(), blogID, form)
+		if err != nil {
+			if errors.Is(err, errDomainTaken) {
+				app.Error(w, r, http.StatusConflict, err.Error())
+				return
+			}
+			if errors.Is(err, errDomainUnverified) {
+				app.Error(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, r, "/blog/"+blog.BlogIDString()+"/", http.StatusFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		app.blogList(w, r, currentUserID)
+		return
+	}
+
+	// Create a new blog. Its comment settings are left at their defaults,
+	// and it has no domains, until it is edited.
+	form, err := readBlogForm(r, app.appHost())
+	if err != nil {
+		app.Error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	blogID := ulid.Make()
+	BLOG := sq.New[BLOG]("")
+	_, err = sq.ExecContext(r.Context(), app.DB, sq.
+		InsertInto(BLOG).
+		ColumnValues(func(col *sq.Column) {
+			col.SetUUID(BLOG.BLOG_ID, blogID)
+			col.SetUUID(BLOG.USER_ID, currentUserID)
+			col.SetString(BLOG.TITLE, form.Title)
+			col.SetString(BLOG.DESCRIPTION, form.Description)
+		}).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	http.Redirect(w, r, "/blog/"+strings.ToLower(blogID.String())+"/", http.StatusFound)
+}
+
+// Blog is a blog as it is stored in BLOG.
+type Blog struct {
+	BlogID      ulid.ULID
+	UserID      ulid.ULID
+	Title       string
+	Description string
+	// CommentsEnabled, CommentsModerated and AnonymousComments are the
+	// comment settings of the blog, see BLOG.
+	CommentsEnabled   bool
+	CommentsModerated bool
+	AnonymousComments bool
+}
+
+// BlogIDString returns the blog ID as it appears in URLs.
+func (blog Blog) BlogIDString() string {
+	return strings.ToLower(blog.BlogID.String())
+}
+
+// fetchBlog fetches a blog by its ID. It returns sql.ErrNoRows if there is no
+// such blog.
+func (app *App) fetchBlog(ctx context.Context, blogID ulid.ULID) (Blog, error) {
+	BLOG := sq.New[BLOG]("")
+	return sq.FetchOneContext(ctx, app.DB, sq.
+		From(BLOG).
+		Where(BLOG.BLOG_ID.EqUUID(blogID)).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (blog Blog) {
+			row.UUIDField(&blog.BlogID, BLOG.BLOG_ID)
+			row.UUIDField(&blog.UserID, BLOG.USER_ID)
+			blog.Title = row.StringField(BLOG.TITLE)
+			blog.Description = row.StringField(BLOG.DESCRIPTION)
+			blog.CommentsEnabled = row.BoolField(BLOG.COMMENTS_ENABLED)
+			blog.CommentsModerated = row.BoolField(BLOG.COMMENTS_MODERATED)
+			blog.AnonymousComments = row.BoolField(BLOG.ANONYMOUS_COMMENTS)
+			return blog
+		},
+	)
+}
+
+// blogForm is a blog as it is submitted from the blog editor.
+type blogForm struct {
+	Title             string
+	Description       string
+	CommentsEnabled   bool
+	CommentsModerated bool
+	AnonymousComments bool
+	// Domains are the domains pointed at the blog, see parseDomains.
+	Domains []string
+}
+
+// readBlogForm reads the title, description, comment settings and domains of
+// a blog from the submitted form. The comment settings are checkboxes, which
+// are left out of the form when unchecked. appHost is passed on to
+// parseDomains.
+func readBlogForm(r *http.Request, appHost string) (form blogForm, err error) {
+	err = r.ParseForm()
+	if err != nil {
+		return blogForm{}, err
+	}
+	form.Title = strings.TrimSpace(r.PostForm.Get("title"))
+	form.Description = strings.TrimSpace(r.PostForm.Get("description"))
+	form.CommentsEnabled = r.PostForm.Has("comments_enabled")
+	form.CommentsModerated = r.PostForm.Has("comments_moderated")
+	form.AnonymousComments = r.PostForm.Has("anonymous_comments")
+	form.Domains, err = parseDomains(r.PostForm.Get("domains"), appHost)
+	if err != nil {
+		return blogForm{}, err
+	}
+	if form.Title == "" {
+		return blogForm{}, errors.New("blog title is required")
+	}
+	if utf8.RuneCountInString(form.Title) > 255 {
+		return blogForm{}, errors.New("blog title is longer than 255 characters")
+	}
+	if utf8.RuneCountInString(form.Description) > 1000 {
+		return blogForm{}, errors.New("blog description is longer than 1000 characters")
+	}
+	return form, nil
+}
+
+// updateBlog saves the settings of a blog from the blog editor and replaces
+// its domains. It returns errDomainUnverified if a domain that the blog didn't
+// have yet fails verifyDomain, and errDomainTaken if one of the domains is
+// already pointed at another blog.
+func (app *App) updateBlog(ctx context.Context, blogID ulid.ULID, form blogForm) error {
+	// The DNS lookups are done before the transaction so that they don't
+	// hold it open.
+	domains, err := app.blogDomains(ctx, blogID)
+	if err != nil {
+		return err
+	}
+	verified := make(map[string]bool)
+	for _, domain := range domains {
+		verified[domain] = true
+	}
+	for _, domain := range form.Domains {
+		if verified[domain] {
+			continue
+		}
+		err = verifyDomain(ctx, domain, blogID)
+		if err != nil {
+			return err
+		}
+	}
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	BLOG := sq.New[BLOG]("")
+	_, err = sq.ExecContext(ctx, tx, sq.
+		Update(BLOG).
+		Set(
+			BLOG.TITLE.SetString(form.Title),
+			BLOG.DESCRIPTION.SetString(form.Description),
+			BLOG.COMMENTS_ENABLED.SetBool(form.CommentsEnabled),
+			BLOG.COMMENTS_MODERATED.SetBool(form.CommentsModerated),
+			BLOG.ANONYMOUS_COMMENTS.SetBool(form.AnonymousComments),
+		).
+		Where(BLOG.BLOG_ID.EqUUID(blogID)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	err = app.setBlogDomains(ctx, tx, blogID, form.Domains)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	app.domainCache.clear()
+	return nil
+}
+
+// blogIndex renders the public index page of a blog.
+func (app *App) blogIndex(w http.ResponseWriter, r *http.Request, base32BlogID string) {
+	if len(base32BlogID) != ulid.EncodedSize {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	if name := strings.ToLower(base32BlogID); name != base32BlogID {
+		http.Redirect(w, r, "/blog/"+name+"/", http.StatusMovedPermanently)
+		return
+	}
+	blogID, err := ulid.Parse(base32BlogID)
+	if err != nil {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	blog, err := app.fetchBlog(r.Context(), blogID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	currentUserID, loggedIn := app.CurrentUserID(r)
+	var buf bytes.Buffer
+	err = app.renderBlogIndex(r.Context(), &buf, blog, blogLinks(r, blog.BlogIDString()), loggedIn && currentUserID == blog.UserID)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	setThemeHeaders(w)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// renderBlogIndex renders the index page of a blog with its theme, which lists
+// its visible posts starting from the most recently published. The owner of
+// the blog also gets the links to edit it, and the list of its drafts and
+// scheduled posts.
+func (app *App) renderBlogIndex(ctx context.Context, w io.Writer, blog Blog, links siteLinks, isOwner bool) error {
+	templateData := themeData{
+		Blog:    blog,
+		Title:   blog.Title,
+		IsOwner: isOwner,
+		Links:   links,
+	}
+	POST := sq.New[POST]("")
+	rowmapper := func(row *sq.Row) (post Post) {
+		row.UUIDField(&post.PostID, POST.POST_ID)
+		post.Title = row.StringField(POST.TITLE)
+		post.Status = row.StringField(POST.STATUS)
+		post.PublishAt = row.TimeField(POST.PUBLISH_AT)
+		post.Slug = row.StringField(POST.SLUG)
+		return post
+	}
+	var err error
+	templateData.Posts, err = sq.FetchAllContext(ctx, app.DB, sq.
+		From(POST).
+		Where(
+			POST.BLOG_ID.EqUUID(blog.BlogID),
+			visiblePosts(POST),
+		).
+		OrderBy(POST.PUBLISH_AT.Desc(), POST.POST_ID.Desc()).
+		SetDialect(app.Dialect),
+		rowmapper,
+	)
+	if err != nil {
+		return err
+	}
+	if isOwner {
+		templateData.PendingComments, err = app.pendingComments(ctx, blog.BlogID)
+		if err != nil {
+			return err
+		}
+		templateData.Drafts, err = sq.FetchAllContext(ctx, app.DB, sq.
+			From(POST).
+			Where(
+				POST.BLOG_ID.EqUUID(blog.BlogID),
+				sq.Or(
+					POST.STATUS.EqString(postDraft),
+					POST.PUBLISH_AT.GtTime(time.Now().UTC()),
+				),
+			).
+			OrderBy(POST.POST_ID.Desc()).
+			SetDialect(app.Dialect),
+			rowmapper,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	tags, err := app.postTags(ctx, POST.BLOG_ID.EqUUID(blog.BlogID))
+	if err != nil {
+		return err
+	}
+	for i := range templateData.Posts {
+		templateData.Posts[i].Tags = tags[templateData.Posts[i].PostID]
+	}
+	for i := range templateData.Drafts {
+		templateData.Drafts[i].Tags = tags[templateData.Drafts[i].PostID]
+	}
+	return app.renderTheme(ctx, w, "index", templateData)
+}
+
+// siteLinks builds the links between the pages of a blog. The live server
+// links to absolute paths, while a static export of the blog (see ExportSite)
+// links relative to the current page, with the blog at the root of the site.
+type siteLinks struct {
+	BlogID string
+
+	// Export is true for the pages of a static export.
+	Export bool
+
+	// Domain is true for the pages of a blog served on its own domain (see
+	// BLOG_DOMAIN), where the blog is at the root of the domain.
+	Domain bool
+
+	// Root is prepended to every link. It is the base URL for the absolute
+	// links in feeds, or the path from the current page to the root of an
+	// exported site (such as "../../").
+	Root string
+}
+
+// Blog returns the link to the index page of the blog.
+func (links siteLinks) Blog() string {
+	if links.Export {
+		if links.Root == "" {
+			return "./"
+		}
+		return links.Root
+	}
+	if links.Domain {
+		return links.Root + "/"
+	}
+	return links.Root + "/blog/" + links.BlogID + "/"
+}
+
+// Post returns the link to a post by its slug.
+func (links siteLinks) Post(slug string) string {
+	if links.Export {
+		return links.Root + "post/" + url.PathEscape(slug) + "/"
+	}
+	if links.Domain {
+		return links.Root + "/" + url.PathEscape(slug)
+	}
+	return links.Root + "/blog/" + links.BlogID + "/" + url.PathEscape(slug)
+}
+
+// Tag returns the link to the page of a tag.
+func (links siteLinks) Tag(tag string) string {
+	if links.Export {
+		return links.Root + "tag/" + url.PathEscape(tag) + "/"
+	}
+	if links.Domain {
+		return links.Root + "/tag/" + url.PathEscape(tag)
+	}
+	return links.Root + "/blog/" + links.BlogID + "/tag/" + url.PathEscape(tag)
+}
+
+// Static returns the link to a file in the static directory. Exported sites
+// have the gzipped files decompressed, since static hosting generally can't
+// serve them with Content-Encoding: gzip.
+func (links siteLinks) Static(name string) string {
+	if links.Export {
+		return links.Root + "static/" + strings.TrimSuffix(name, ".gz")
+	}
+	return links.Root + "/static/" + name
+}
+
+// blogList renders the blogs owned by a user, along with the form to create a
+// new blog.
+func (app *App) blogList(w http.ResponseWriter, r *http.Request, userID ulid.ULID) {
+	BLOG := sq.New[BLOG]("")
+	blogs, err := sq.FetchAllContext(r.Context(), app.DB, sq.
+		From(BLOG).
+		Where(BLOG.USER_ID.EqUUID(userID)).
+		OrderBy(BLOG.BLOG_ID).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (blog Blog) {
+			row.UUIDField(&blog.BlogID, BLOG.BLOG_ID)
+			blog.Title = row.StringField(BLOG.TITLE)
+			return blog
+		},
+	)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	tmpl, err := template.ParseFiles("html/blogs.html")
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]any{
+		"Blogs": blogs,
+	})
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// blogEditor renders the form for editing a blog's title and description.
+func (app *App) blogEditor(w http.ResponseWriter, r *http.Request, blog Blog) {
+	tmpl, err := template.ParseFiles("html/edit_blog.html")
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	domains, err := app.blogDomains(r.Context(), blog.BlogID)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, struct {
+		Blog
+		// Domains are the domains pointed at the blog, one per line.
+		Domains string
+		// DomainsEnabled is whether blogs can have domains, which they
+		// can't until notebrew has a base URL.
+		DomainsEnabled bool
+		// DomainVerificationValue is the value of the TXT record that
+		// points a domain at the blog, see verifyDomain.
+		DomainVerificationValue string
+		// HCaptchaTestKeys is whether anonymous comments are unavailable
+		// because the site uses hCaptcha's test keys.
+		HCaptchaTestKeys bool
+	}{
+		Blog:                    blog,
+		Domains:                 strings.Join(domains, "\n"),
+		DomainsEnabled:          app.appHost() != "",
+		DomainVerificationValue: domainVerificationValue(blog.BlogID),
+		HCaptchaTestKeys:        app.HCaptchaTestKeys(),
+	})
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,458 @@
+package notebrew
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// The statuses of a comment. Comments on a blog that moderates its comments
+// are pending until the owner of the blog approves or rejects them, and only
+// approved comments are shown on the post.
+const (
+	commentPending  = "pending"
+	commentApproved = "approved"
+	commentRejected = "rejected"
+)
+
+// maxCommentLength is the maximum length of a comment in characters, matching
+// the length of COMMENT.BODY.
+const maxCommentLength = 5000
+
+// maxCommentNameLength is the maximum length of the name a comment is written
+// under in characters, matching the length of COMMENT.NAME.
+const maxCommentNameLength = 100
+
+// commentsPerPage is the number of comments shown on each page of the
+// moderation queue.
+const commentsPerPage = 50
+
+// Comment handles the comments on posts. POST /comment/ comments on the post
+// post_id, while POST /comment/<commentID>/approve, /reject and /delete
+// moderate a comment, which only the owner of its blog can do.
+func (app *App) Comment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		app.Error(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/")
+	if segments[0] != "comment" || len(segments) == 2 || len(segments) > 3 {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	if len(segments) == 1 {
+		app.createComment(w, r)
+		return
+	}
+	action := segments[2]
+	if action != "approve" && action != "reject" && action != "delete" {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	currentUserID, loggedIn := app.CurrentUserID(r)
+	if !loggedIn {
+		app.Redirect(w, r, "/login", map[string]string{
+			"RedirectTo": r.URL.Path,
+		})
+		return
+	}
+	commentID, err := ulid.Parse(segments[1])
+	if err != nil {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	comment, err := app.fetchComment(r.Context(), commentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if comment.Post.Blog.UserID != currentUserID {
+		app.Error(w, r, http.StatusForbidden, nil)
+		return
+	}
+	COMMENT := sq.New[COMMENT]("")
+	if action == "delete" {
+		_, err = sq.ExecContext(r.Context(), app.DB, sq.
+			DeleteFrom(COMMENT).
+			Where(COMMENT.COMMENT_ID.EqUUID(commentID)).
+			SetDialect(app.Dialect),
+		)
+	} else {
+		status := commentApproved
+		if action == "reject" {
+			status = commentRejected
+		}
+		_, err = sq.ExecContext(r.Context(), app.DB, sq.
+			Update(COMMENT).
+			Set(COMMENT.STATUS.SetString(status)).
+			Where(COMMENT.COMMENT_ID.EqUUID(commentID)).
+			SetDialect(app.Dialect),
+		)
+	}
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// Go back to the list of comments that the comment was in.
+	http.Redirect(w, r, commentQueueURL(comment.Post.Blog, comment.Status), http.StatusFound)
+}
+
+// createComment adds a comment to a post from the comment form on the page of
+// the post, then redirects back to the post. Readers who aren't logged in
+// have to pass a captcha, if the blog lets them comment at all. The comment
+// is pending until the owner of the blog approves it, unless the blog doesn't
+// moderate its comments or the comment is by its owner.
+func (app *App) createComment(w http.ResponseWriter, r *http.Request) {
+	// Leave room for the name, the captcha response and the form encoding.
+	r.Body = http.MaxBytesReader(w, r.Body, 16*maxCommentLength)
+	err := r.ParseForm()
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			app.Error(w, r, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		app.Error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	postID, err := ulid.Parse(r.PostForm.Get("post_id"))
+	if err != nil {
+		app.Error(w, r, http.StatusBadRequest, "invalid post")
+		return
+	}
+	post, err := app.fetchPost(r.Context(), postID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !post.Visible() {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	if !post.Blog.CommentsEnabled {
+		app.Error(w, r, http.StatusForbidden, "comments are turned off for this blog")
+		return
+	}
+	postURL := blogLinks(r, post.Blog.BlogIDString()).Post(post.Slug)
+	currentUserID, loggedIn := app.CurrentUserID(r)
+	if !loggedIn && !app.anonymousComments(post.Blog) {
+		app.Redirect(w, r, "/login", map[string]string{
+			"RedirectTo": postURL,
+		})
+		return
+	}
+
+	// Mistakes in the comment are shown in the comment form, which is
+	// filled in again with what was submitted.
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	// Browsers submit textareas with CRLF line endings.
+	body := strings.TrimSpace(strings.ReplaceAll(r.PostForm.Get("body"), "\r\n", "\n"))
+	commentError := func(errMsg string) {
+		app.Redirect(w, r, postURL+"#comment-form", map[string]string{
+			"Name":  name,
+			"Body":  body,
+			"Error": errMsg,
+		})
+	}
+	if body == "" {
+		commentError("comment is empty")
+		return
+	}
+	if utf8.RuneCountInString(body) > maxCommentLength {
+		commentError("comment is longer than 5000 characters")
+		return
+	}
+	if utf8.RuneCountInString(name) > maxCommentNameLength {
+		commentError("name is longer than 100 characters")
+		return
+	}
+	if !loggedIn {
+		success, err := app.verifyHCaptcha(r.Context(), r.PostForm.Get("h-captcha-response"))
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !success {
+			commentError("failed captcha")
+			return
+		}
+	}
+
+	status := commentPending
+	if !post.Blog.CommentsModerated || (loggedIn && currentUserID == post.Blog.UserID) {
+		status = commentApproved
+	}
+	COMMENT := sq.New[COMMENT]("")
+	_, err = sq.ExecContext(r.Context(), app.DB, sq.
+		InsertInto(COMMENT).
+		ColumnValues(func(col *sq.Column) {
+			col.SetUUID(COMMENT.COMMENT_ID, ulid.Make())
+			col.SetUUID(COMMENT.POST_ID, post.PostID)
+			if loggedIn {
+				col.SetUUID(COMMENT.USER_ID, currentUserID)
+			}
+			col.SetString(COMMENT.NAME, name)
+			col.SetString(COMMENT.BODY, body)
+			col.SetString(COMMENT.STATUS, status)
+		}).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if status == commentPending {
+		app.Redirect(w, r, postURL+"#comment-form", map[string]string{
+			"Message": "Thanks! Your comment will be shown once it is approved.",
+		})
+		return
+	}
+	http.Redirect(w, r, postURL+"#comments", http.StatusFound)
+}
+
+// Comment is a comment on a post as it is stored in COMMENT.
+type Comment struct {
+	CommentID ulid.ULID
+	// Post is the post that was commented on, with only its ID, blog, title
+	// and slug filled in.
+	Post Post
+	// Name is the name the comment was written under, which may be empty.
+	Name   string
+	Body   string
+	Status string
+	// ByOwner is whether the comment was written by the owner of the
+	// blog.
+	ByOwner bool
+}
+
+// CommentIDString returns the comment ID as it appears in URLs.
+func (comment Comment) CommentIDString() string {
+	return strings.ToLower(comment.CommentID.String())
+}
+
+// CreatedAt returns when the comment was written.
+func (comment Comment) CreatedAt() time.Time {
+	return ulid.Time(comment.CommentID.Time())
+}
+
+// Author returns the name the comment was written under, or "Anonymous" if it
+// was written without one.
+func (comment Comment) Author() string {
+	if comment.Name == "" {
+		return "Anonymous"
+	}
+	return comment.Name
+}
+
+// anonymousComments reports whether readers can comment on the posts of a
+// blog without logging in. They can't while the site uses hCaptcha's test
+// keys, whatever the blog's settings, since the captcha wouldn't stop any
+// bots.
+func (app *App) anonymousComments(blog Blog) bool {
+	return blog.AnonymousComments && !app.HCaptchaTestKeys()
+}
+
+// commentForm is the form for commenting on a post, shown by the post template
+// of a theme.
+type commentForm struct {
+	PostID string
+	// LoggedIn is whether the reader is logged in. Readers who aren't have
+	// to pass a captcha.
+	LoggedIn bool
+	// LoginRequired is whether the reader has to log in to comment, because
+	// the blog doesn't allow anonymous comments.
+	LoginRequired   bool
+	HCaptchaSiteKey string
+	// Name, Body and Error are the comment that was just submitted and why
+	// it couldn't be added, if it couldn't.
+	Name  string
+	Body  string
+	Error string
+	// Message is shown after a comment was added but is waiting for
+	// approval.
+	Message string
+}
+
+// fetchComments fetches the comments that match the predicate, up to limit
+// comments from the oldest or the newest.
+func (app *App) fetchComments(ctx context.Context, predicate sq.Predicate, newestFirst bool, limit int) ([]Comment, error) {
+	COMMENT := sq.New[COMMENT]("")
+	POST := sq.New[POST]("")
+	BLOG := sq.New[BLOG]("")
+	order := COMMENT.COMMENT_ID.Asc()
+	if newestFirst {
+		order = COMMENT.COMMENT_ID.Desc()
+	}
+	return sq.FetchAllContext(ctx, app.DB, sq.
+		From(COMMENT).
+		Join(POST, POST.POST_ID.Eq(COMMENT.POST_ID)).
+		Join(BLOG, BLOG.BLOG_ID.Eq(POST.BLOG_ID)).
+		Where(predicate).
+		OrderBy(order).
+		Limit(limit).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (comment Comment) {
+			row.UUIDField(&comment.CommentID, COMMENT.COMMENT_ID)
+			row.UUIDField(&comment.Post.PostID, POST.POST_ID)
+			row.UUIDField(&comment.Post.Blog.BlogID, BLOG.BLOG_ID)
+			row.UUIDField(&comment.Post.Blog.UserID, BLOG.USER_ID)
+			comment.Post.Blog.Title = row.StringField(BLOG.TITLE)
+			comment.Post.Title = row.StringField(POST.TITLE)
+			comment.Post.Slug = row.StringField(POST.SLUG)
+			comment.Name = row.StringField(COMMENT.NAME)
+			comment.Body = row.StringField(COMMENT.BODY)
+			comment.Status = row.StringField(COMMENT.STATUS)
+			// Anonymous comments have a NULL user ID, which compares
+			// as NULL and is scanned as false.
+			comment.ByOwner = row.Bool("{} = {}", COMMENT.USER_ID, BLOG.USER_ID)
+			return comment
+		},
+	)
+}
+
+// fetchComment fetches a comment and the post it is on by the comment ID. It
+// returns sql.ErrNoRows if there is no such comment.
+func (app *App) fetchComment(ctx context.Context, commentID ulid.ULID) (Comment, error) {
+	COMMENT := sq.New[COMMENT]("")
+	comments, err := app.fetchComments(ctx, COMMENT.COMMENT_ID.EqUUID(commentID), false, 1)
+	if err != nil {
+		return Comment{}, err
+	}
+	if len(comments) == 0 {
+		return Comment{}, sql.ErrNoRows
+	}
+	return comments[0], nil
+}
+
+// maxPostComments is the maximum number of comments shown on a post.
+const maxPostComments = 1000
+
+// postComments fetches the approved comments on a post, oldest first.
+func (app *App) postComments(ctx context.Context, postID ulid.ULID) ([]Comment, error) {
+	COMMENT := sq.New[COMMENT]("")
+	return app.fetchComments(ctx, sq.And(
+		COMMENT.POST_ID.EqUUID(postID),
+		COMMENT.STATUS.EqString(commentApproved),
+	), false, maxPostComments)
+}
+
+// pendingComments returns the number of comments on the posts of a blog that
+// are waiting for approval.
+func (app *App) pendingComments(ctx context.Context, blogID ulid.ULID) (int, error) {
+	COMMENT := sq.New[COMMENT]("")
+	POST := sq.New[POST]("")
+	return sq.FetchOneContext(ctx, app.DB, sq.
+		From(COMMENT).
+		Join(POST, POST.POST_ID.Eq(COMMENT.POST_ID)).
+		Where(
+			POST.BLOG_ID.EqUUID(blogID),
+			COMMENT.STATUS.EqString(commentPending),
+		).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) int {
+			return row.Int("COUNT(*)")
+		},
+	)
+}
+
+// commentQueueURL returns the URL of the list of a blog's comments with a
+// status in the moderation queue.
+func commentQueueURL(blog Blog, status string) string {
+	if status == commentPending {
+		return "/blog/" + blog.BlogIDString() + "/?comments"
+	}
+	return "/blog/" + blog.BlogIDString() + "/?comments=" + status
+}
+
+// commentQueue renders the moderation queue of a blog to its owner:
+// /blog/<blogID>/?comments lists the comments waiting for approval, newest
+// first, while ?comments=approved and ?comments=rejected list the comments
+// that have been approved or rejected. Each page lists commentsPerPage
+// comments, and ?before=<commentID> lists the comments older than
+// <commentID>.
+func (app *App) commentQueue(w http.ResponseWriter, r *http.Request, blog Blog) {
+	type TemplateData struct {
+		Blog     Blog
+		Links    siteLinks
+		Status   string
+		Comments []Comment
+		// Before is the comment ID to list the older comments from, or
+		// empty if there are none.
+		Before string
+	}
+
+	status := r.URL.Query().Get("comments")
+	switch status {
+	case "":
+		status = commentPending
+	case commentPending, commentApproved, commentRejected:
+	default:
+		app.Error(w, r, http.StatusBadRequest, "invalid comment status")
+		return
+	}
+	COMMENT := sq.New[COMMENT]("")
+	POST := sq.New[POST]("")
+	predicates := []sq.Predicate{
+		POST.BLOG_ID.EqUUID(blog.BlogID),
+		COMMENT.STATUS.EqString(status),
+	}
+	if s := r.URL.Query().Get("before"); s != "" {
+		before, err := ulid.Parse(s)
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, "invalid before parameter")
+			return
+		}
+		predicates = append(predicates, sq.Lt(COMMENT.COMMENT_ID, sq.UUIDValue(before)))
+	}
+	comments, err := app.fetchComments(r.Context(), sq.And(predicates...), true, commentsPerPage+1)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	templateData := TemplateData{
+		Blog:   blog,
+		Links:  siteLinks{BlogID: blog.BlogIDString()},
+		Status: status,
+	}
+	if len(comments) > commentsPerPage {
+		comments = comments[:commentsPerPage]
+		templateData.Before = comments[len(comments)-1].CommentIDString()
+	}
+	templateData.Comments = comments
+	tmpl, err := template.ParseFiles("html/comments.html")
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, templateData)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
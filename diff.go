@@ -0,0 +1,94 @@
+package notebrew
+
+import "strings"
+
+// diffLine is a single line in a line diff.
+type diffLine struct {
+	// Op is "+" if the line was added, "-" if the line was removed and " " if
+	// the line is unchanged.
+	Op   string
+	Text string
+}
+
+// maxDiffCells caps the size of the table used to compute the longest common
+// subsequence of lines, which is proportional to the product of the number of
+// lines in both texts.
+const maxDiffCells = 4 << 20
+
+// lineDiff returns the line diff that turns a into b.
+func lineDiff(a, b string) []diffLine {
+	var aLines, bLines []string
+	if a != "" {
+		aLines = strings.Split(strings.ReplaceAll(a, "\r\n", "\n"), "\n")
+	}
+	if b != "" {
+		bLines = strings.Split(strings.ReplaceAll(b, "\r\n", "\n"), "\n")
+	}
+
+	// Lines at the start and end that are common to both texts don't need to
+	// go through the LCS table.
+	var prefix, suffix int
+	for prefix < len(aLines) && prefix < len(bLines) && aLines[prefix] == bLines[prefix] {
+		prefix++
+	}
+	for suffix < len(aLines)-prefix && suffix < len(bLines)-prefix &&
+		aLines[len(aLines)-1-suffix] == bLines[len(bLines)-1-suffix] {
+		suffix++
+	}
+	lines := make([]diffLine, 0, len(aLines)+len(bLines))
+	for _, line := range aLines[:prefix] {
+		lines = append(lines, diffLine{Op: " ", Text: line})
+	}
+	aMiddle := aLines[prefix : len(aLines)-suffix]
+	bMiddle := bLines[prefix : len(bLines)-suffix]
+	n, m := len(aMiddle), len(bMiddle)
+	if n*m > maxDiffCells {
+		// Too big to diff line by line, show the whole middle as replaced.
+		for _, line := range aMiddle {
+			lines = append(lines, diffLine{Op: "-", Text: line})
+		}
+		for _, line := range bMiddle {
+			lines = append(lines, diffLine{Op: "+", Text: line})
+		}
+	} else {
+		// lcs[i*(m+1)+j] is the length of the longest common subsequence of
+		// aMiddle[i:] and bMiddle[j:].
+		lcs := make([]int32, (n+1)*(m+1))
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if aMiddle[i] == bMiddle[j] {
+					lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+				} else if lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1] {
+					lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j]
+				} else {
+					lcs[i*(m+1)+j] = lcs[i*(m+1)+j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < n && j < m {
+			switch {
+			case aMiddle[i] == bMiddle[j]:
+				lines = append(lines, diffLine{Op: " ", Text: aMiddle[i]})
+				i++
+				j++
+			case lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+				lines = append(lines, diffLine{Op: "-", Text: aMiddle[i]})
+				i++
+			default:
+				lines = append(lines, diffLine{Op: "+", Text: bMiddle[j]})
+				j++
+			}
+		}
+		for ; i < n; i++ {
+			lines = append(lines, diffLine{Op: "-", Text: aMiddle[i]})
+		}
+		for ; j < m; j++ {
+			lines = append(lines, diffLine{Op: "+", Text: bMiddle[j]})
+		}
+	}
+	for _, line := range aLines[len(aLines)-suffix:] {
+		lines = append(lines, diffLine{Op: " ", Text: line})
+	}
+	return lines
+}
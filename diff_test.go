@@ -0,0 +1,117 @@
+package notebrew
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	type TestTable struct {
+		description string
+		a, b        string
+		wantLines   []diffLine
+	}
+
+	tests := []TestTable{{
+		description: "both empty",
+		a:           "",
+		b:           "",
+		wantLines:   []diffLine{},
+	}, {
+		description: "from empty",
+		a:           "",
+		b:           "one\ntwo",
+		wantLines: []diffLine{
+			{Op: "+", Text: "one"},
+			{Op: "+", Text: "two"},
+		},
+	}, {
+		description: "to empty",
+		a:           "one\ntwo",
+		b:           "",
+		wantLines: []diffLine{
+			{Op: "-", Text: "one"},
+			{Op: "-", Text: "two"},
+		},
+	}, {
+		description: "identical",
+		a:           "one\ntwo\nthree",
+		b:           "one\ntwo\nthree",
+		wantLines: []diffLine{
+			{Op: " ", Text: "one"},
+			{Op: " ", Text: "two"},
+			{Op: " ", Text: "three"},
+		},
+	}, {
+		description: "all changed",
+		a:           "one\ntwo",
+		b:           "three\nfour",
+		wantLines: []diffLine{
+			{Op: "-", Text: "one"},
+			{Op: "-", Text: "two"},
+			{Op: "+", Text: "three"},
+			{Op: "+", Text: "four"},
+		},
+	}, {
+		description: "line changed in the middle",
+		a:           "one\ntwo\nthree",
+		b:           "one\n2\nthree",
+		wantLines: []diffLine{
+			{Op: " ", Text: "one"},
+			{Op: "-", Text: "two"},
+			{Op: "+", Text: "2"},
+			{Op: " ", Text: "three"},
+		},
+	}, {
+		description: "lines added and removed",
+		a:           "a\nb\nc\nd",
+		b:           "b\nc\ne\nd",
+		wantLines: []diffLine{
+			{Op: "-", Text: "a"},
+			{Op: " ", Text: "b"},
+			{Op: " ", Text: "c"},
+			{Op: "+", Text: "e"},
+			{Op: " ", Text: "d"},
+		},
+	}, {
+		description: "CRLF line endings",
+		a:           "one\r\ntwo",
+		b:           "one\ntwo",
+		wantLines: []diffLine{
+			{Op: " ", Text: "one"},
+			{Op: " ", Text: "two"},
+		},
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			t.Parallel()
+			gotLines := lineDiff(tt.a, tt.b)
+			if !reflect.DeepEqual(gotLines, tt.wantLines) {
+				t.Errorf("\ngot  %q\nwant %q", gotLines, tt.wantLines)
+			}
+		})
+	}
+}
+
+func TestLineDiffTooBig(t *testing.T) {
+	// Past maxDiffCells, the differing middle is shown as replaced while the
+	// common prefix and suffix are still kept.
+	var a, b []string
+	for i := 0; i < 2100; i++ {
+		a = append(a, "a")
+		b = append(b, "b")
+	}
+	lines := lineDiff("start\n"+strings.Join(a, "\n")+"\nend", "start\n"+strings.Join(b, "\n")+"\nend")
+	if len(lines) != 2+2*2100 {
+		t.Fatalf("got %d lines, want %d", len(lines), 2+2*2100)
+	}
+	if lines[0] != (diffLine{Op: " ", Text: "start"}) || lines[len(lines)-1] != (diffLine{Op: " ", Text: "end"}) {
+		t.Errorf("common prefix or suffix not kept: %q, %q", lines[0], lines[len(lines)-1])
+	}
+	if lines[1].Op != "-" || lines[2100].Op != "-" || lines[2101].Op != "+" || lines[4200].Op != "+" {
+		t.Errorf("middle not shown as replaced")
+	}
+}
@@ -0,0 +1,381 @@
+package notebrew
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// maxBlogDomains is the maximum number of domains that can be pointed at a
+// blog.
+const maxBlogDomains = 10
+
+// errDomainTaken is returned when a domain is already pointed at another blog.
+var errDomainTaken = errors.New("domain is already used by another blog")
+
+// errDomainUnverified is returned when a domain is pointed at a blog without
+// the TXT record that proves its owner wants it to be, see verifyDomain.
+var errDomainUnverified = errors.New("domain has no TXT record pointing it at this blog")
+
+// domainVerificationTimeout is how long verifyDomain waits for the TXT
+// records of a domain.
+const domainVerificationTimeout = 10 * time.Second
+
+// domainCacheTTL is how long hostBlog remembers which blog a host is the
+// domain of, or that it isn't the domain of any blog, so that requests with
+// made-up hosts don't each query the database. It also bounds how long
+// another notebrew sharing the database takes to notice a domain change.
+const domainCacheTTL = time.Minute
+
+// maxDomainCacheSize is the maximum number of hosts that hostBlog remembers.
+// The cache is emptied once it is full, so that requests with made-up hosts
+// can't grow it without bound.
+const maxDomainCacheSize = 10000
+
+// domainCache remembers the results of hostBlog, see domainCacheTTL. Its zero
+// value is an empty cache.
+type domainCache struct {
+	mu      sync.Mutex
+	entries map[string]domainCacheEntry
+}
+
+// domainCacheEntry is the blog that a host is the domain of, if found is
+// true.
+type domainCacheEntry struct {
+	blogID    ulid.ULID
+	found     bool
+	expiresAt time.Time
+}
+
+// get returns the entry of a domain, if it hasn't expired.
+func (c *domainCache) get(domain string) (domainCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[domain]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return domainCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// set sets the entry of a domain.
+func (c *domainCache) set(domain string, entry domainCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= maxDomainCacheSize {
+		c.entries = make(map[string]domainCacheEntry)
+	}
+	entry.expiresAt = time.Now().Add(domainCacheTTL)
+	c.entries[domain] = entry
+}
+
+// clear empties the cache.
+func (c *domainCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// lookupTXT looks up the TXT records of a domain. It is a variable so that
+// tests don't need DNS.
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+// domainRegexp matches a valid domain name: dot-separated labels of
+// lowercase letters, digits and hyphens that don't start or end with a
+// hyphen.
+var domainRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
+// blogDomainKey is the context key of the ID of the blog whose domain a
+// request arrived on, see App.Handler.
+type blogDomainKey struct{}
+
+// requestBlogDomain returns the ID of the blog whose domain the request
+// arrived on, if it did.
+func requestBlogDomain(r *http.Request) (ulid.ULID, bool) {
+	blogID, ok := r.Context().Value(blogDomainKey{}).(ulid.ULID)
+	return blogID, ok
+}
+
+// blogLinks returns the links between the pages of a blog for a request. The
+// pages of a blog requested on its own domain link to each other from the
+// root of the domain rather than from /blog/<blogID>/.
+func blogLinks(r *http.Request, base32BlogID string) siteLinks {
+	links := siteLinks{BlogID: base32BlogID}
+	if blogID, ok := requestBlogDomain(r); ok && strings.ToLower(blogID.String()) == base32BlogID {
+		links.Domain = true
+	}
+	return links
+}
+
+// normalizeHost returns the domain of a request's Host header, without its
+// port and in lowercase.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// appHost returns the host of app.BaseURL, or an empty string if BaseURL
+// isn't set.
+func (app *App) appHost() string {
+	if app.BaseURL == "" {
+		return ""
+	}
+	u, err := url.Parse(app.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return normalizeHost(u.Host)
+}
+
+// hostBlog returns the ID of the blog that a host is the domain of. It returns
+// sql.ErrNoRows if the host isn't the domain of any blog. Either answer is
+// cached in app.domainCache.
+func (app *App) hostBlog(ctx context.Context, host string) (ulid.ULID, error) {
+	domain := normalizeHost(host)
+	// Without a base URL there is no telling the host of notebrew itself
+	// apart from the domains of blogs, so blogs don't get domains at all.
+	// The host of notebrew is never the domain of a blog either, so
+	// requests for the app don't need to look it up.
+	appHost := app.appHost()
+	if appHost == "" || domain == appHost || domain == "" {
+		return ulid.ULID{}, sql.ErrNoRows
+	}
+	if entry, ok := app.domainCache.get(domain); ok {
+		if !entry.found {
+			return ulid.ULID{}, sql.ErrNoRows
+		}
+		return entry.blogID, nil
+	}
+	BLOG_DOMAIN := sq.New[BLOG_DOMAIN]("")
+	blogID, err := sq.FetchOneContext(ctx, app.DB, sq.
+		From(BLOG_DOMAIN).
+		Where(BLOG_DOMAIN.DOMAIN.EqString(domain)).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (blogID ulid.ULID) {
+			row.UUIDField(&blogID, BLOG_DOMAIN.BLOG_ID)
+			return blogID
+		},
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.domainCache.set(domain, domainCacheEntry{found: false})
+		}
+		return ulid.ULID{}, err
+	}
+	app.domainCache.set(domain, domainCacheEntry{blogID: blogID, found: true})
+	return blogID, nil
+}
+
+// serveBlogDomain serves a request that arrived on the domain of a blog. The
+// pages of the blog are at the root of the domain: / is its index page,
+// /<slug> are its posts and /tag/<tag> are the pages of its tags, along with
+// its feeds, /sitemap.xml and /robots.txt. The static files, images and
+// comment form that its pages use are served as well, but nothing else of
+// the app.
+func (app *App) serveBlogDomain(w http.ResponseWriter, r *http.Request, blogID ulid.ULID) {
+	base32BlogID := strings.ToLower(blogID.String())
+	switch {
+	case r.URL.Path == "/error":
+		app.ErrorPage(w, r)
+		return
+	case r.URL.Path == "/comment/":
+		app.Comment(w, r)
+		return
+	case strings.HasPrefix(r.URL.Path, "/static/"):
+		app.Static(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		app.Error(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	switch r.URL.Path {
+	case "/":
+		app.blogIndex(w, r, base32BlogID)
+		return
+	case "/feed.xml", "/rss.xml":
+		app.blogFeed(w, r, base32BlogID, strings.TrimPrefix(r.URL.Path, "/"))
+		return
+	case "/sitemap.xml":
+		app.Sitemap(w, r)
+		return
+	case "/robots.txt":
+		app.Robots(w, r)
+		return
+	}
+	segments := strings.Split(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/")
+	switch {
+	case len(segments) == 1:
+		app.blogPost(w, r, base32BlogID, segments[0])
+	case len(segments) == 2 && segments[0] == "tag":
+		app.blogTag(w, r, base32BlogID, segments[1])
+	case len(segments) == 2 && segments[0] == "image":
+		app.serveImage(w, r, segments[1])
+	default:
+		app.Error(w, r, http.StatusNotFound, nil)
+	}
+}
+
+// blogDomains returns the domains pointed at a blog in alphabetical order.
+func (app *App) blogDomains(ctx context.Context, blogID ulid.ULID) ([]string, error) {
+	BLOG_DOMAIN := sq.New[BLOG_DOMAIN]("")
+	return sq.FetchAllContext(ctx, app.DB, sq.
+		From(BLOG_DOMAIN).
+		Where(BLOG_DOMAIN.BLOG_ID.EqUUID(blogID)).
+		OrderBy(BLOG_DOMAIN.DOMAIN).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) string {
+			return row.StringField(BLOG_DOMAIN.DOMAIN)
+		},
+	)
+}
+
+// parseDomains parses the domains of a blog, separated by commas or
+// whitespace. Domains are lowercased and may be given as URLs, of which only
+// the host is kept. The domains are returned sorted without duplicates.
+//
+// appHost is the host of notebrew itself (see App.appHost), which can't be the
+// domain of a blog. If it is empty no domains are allowed, since blogs only
+// get domains when notebrew has a base URL.
+func parseDomains(s string, appHost string) ([]string, error) {
+	seen := make(map[string]bool)
+	domains := []string{}
+	for _, field := range strings.FieldsFunc(s, func(char rune) bool {
+		return char == ',' || char == ' ' || char == '\t' || char == '\r' || char == '\n'
+	}) {
+		domain := field
+		if strings.Contains(domain, "://") {
+			u, err := url.Parse(domain)
+			if err != nil {
+				return nil, fmt.Errorf("invalid domain %q", field)
+			}
+			domain = u.Host
+		}
+		domain = normalizeHost(domain)
+		if len(domain) > 253 || !domainRegexp.MatchString(domain) {
+			return nil, fmt.Errorf("invalid domain %q", field)
+		}
+		if appHost == "" {
+			return nil, errors.New("blogs can't have domains until notebrew's base URL is set")
+		}
+		if domain == appHost {
+			return nil, fmt.Errorf("%s is the domain of notebrew itself", domain)
+		}
+		if seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		domains = append(domains, domain)
+	}
+	if len(domains) > maxBlogDomains {
+		return nil, fmt.Errorf("a blog can have at most %d domains", maxBlogDomains)
+	}
+	sort.Strings(domains)
+	return domains, nil
+}
+
+// domainVerificationName returns the name of the TXT record that points a
+// domain at a blog.
+func domainVerificationName(domain string) string {
+	return "_notebrew." + domain
+}
+
+// domainVerificationValue returns the value of the TXT record that points a
+// domain at a blog.
+func domainVerificationValue(blogID ulid.ULID) string {
+	return "notebrew-blog=" + strings.ToLower(blogID.String())
+}
+
+// verifyDomain checks that the owner of a domain wants it pointed at a blog,
+// which they show by adding a TXT record to its DNS records (see
+// domainVerificationName and domainVerificationValue). Otherwise anyone could
+// point any domain that resolves to notebrew at their own blog. It returns
+// errDomainUnverified if the record isn't there.
+func verifyDomain(ctx context.Context, domain string, blogID ulid.ULID) error {
+	ctx, cancel := context.WithTimeout(ctx, domainVerificationTimeout)
+	defer cancel()
+	records, err := lookupTXT(ctx, domainVerificationName(domain))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return fmt.Errorf("%s: %w", domain, errDomainUnverified)
+		}
+		return err
+	}
+	want := domainVerificationValue(blogID)
+	for _, record := range records {
+		if strings.TrimSpace(record) == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %w", domain, errDomainUnverified)
+}
+
+// setBlogDomains replaces the domains pointed at a blog. It returns
+// errDomainTaken if one of them is already pointed at another blog. The
+// caller must clear app.domainCache once tx commits, as hostBlog may have
+// cached the old domains.
+func (app *App) setBlogDomains(ctx context.Context, tx *sql.Tx, blogID ulid.ULID, domains []string) error {
+	BLOG_DOMAIN := sq.New[BLOG_DOMAIN]("")
+	if len(domains) > 0 {
+		args := make([]any, len(domains))
+		for i, domain := range domains {
+			args[i] = domain
+		}
+		taken, err := sq.FetchAllContext(ctx, tx, sq.
+			From(BLOG_DOMAIN).
+			Where(
+				BLOG_DOMAIN.DOMAIN.In(args),
+				BLOG_DOMAIN.BLOG_ID.NeUUID(blogID),
+			).
+			OrderBy(BLOG_DOMAIN.DOMAIN).
+			SetDialect(app.Dialect),
+			func(row *sq.Row) string {
+				return row.StringField(BLOG_DOMAIN.DOMAIN)
+			},
+		)
+		if err != nil {
+			return err
+		}
+		if len(taken) > 0 {
+			return fmt.Errorf("%s: %w", taken[0], errDomainTaken)
+		}
+	}
+	_, err := sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(BLOG_DOMAIN).
+		Where(BLOG_DOMAIN.BLOG_ID.EqUUID(blogID)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	for _, domain := range domains {
+		_, err = sq.ExecContext(ctx, tx, sq.
+			InsertInto(BLOG_DOMAIN).
+			ColumnValues(func(col *sq.Column) {
+				col.SetString(BLOG_DOMAIN.DOMAIN, domain)
+				col.SetUUID(BLOG_DOMAIN.BLOG_ID, blogID)
+			}).
+			SetDialect(app.Dialect),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package notebrew
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestParseDomains(t *testing.T) {
+	type TestTable struct {
+		description string
+		s           string
+		appHost     string
+		wantDomains []string
+		wantErr     bool
+	}
+
+	tests := []TestTable{{
+		description: "domains are lowercased, deduplicated and sorted",
+		s:           "Blog.Example.com, https://www.example.com/path\nblog.example.com:8080",
+		appHost:     "notebrew.com",
+		wantDomains: []string{"blog.example.com", "www.example.com"},
+	}, {
+		description: "no domains",
+		s:           " \n ",
+		appHost:     "",
+		wantDomains: []string{},
+	}, {
+		description: "no domains without a base URL",
+		s:           "blog.example.com",
+		appHost:     "",
+		wantErr:     true,
+	}, {
+		description: "the host of notebrew",
+		s:           "blog.example.com NoteBrew.com.",
+		appHost:     "notebrew.com",
+		wantErr:     true,
+	}, {
+		description: "invalid domain",
+		s:           "-blog.example.com",
+		appHost:     "notebrew.com",
+		wantErr:     true,
+	}}
+
+	for _, tt := range tests {
+		gotDomains, err := parseDomains(tt.s, tt.appHost)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", tt.description, gotDomains)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.description, err)
+			continue
+		}
+		if !reflect.DeepEqual(gotDomains, tt.wantDomains) {
+			t.Errorf("%s: got %q, want %q", tt.description, gotDomains, tt.wantDomains)
+		}
+	}
+}
+
+func TestVerifyDomain(t *testing.T) {
+	type TestTable struct {
+		description string
+		records     map[string][]string
+		wantErr     error
+	}
+
+	blogID := ulid.MustParse("01gyj3xnkr4eg6hpbr5ytg7mxh")
+	otherBlogID := ulid.MustParse("01gyj3xnkr4eg6hpbr5ytg7mxj")
+	tests := []TestTable{{
+		description: "record of the blog",
+		records: map[string][]string{
+			"_notebrew.blog.example.com": {"v=spf1 -all", " notebrew-blog=01gyj3xnkr4eg6hpbr5ytg7mxh "},
+		},
+		wantErr: nil,
+	}, {
+		description: "record of another blog",
+		records: map[string][]string{
+			"_notebrew.blog.example.com": {domainVerificationValue(otherBlogID)},
+		},
+		wantErr: errDomainUnverified,
+	}, {
+		description: "record on the domain itself",
+		records: map[string][]string{
+			"blog.example.com": {domainVerificationValue(blogID)},
+		},
+		wantErr: errDomainUnverified,
+	}, {
+		description: "no records",
+		records:     map[string][]string{},
+		wantErr:     errDomainUnverified,
+	}}
+
+	defer func(lookup func(context.Context, string) ([]string, error)) {
+		lookupTXT = lookup
+	}(lookupTXT)
+	for _, tt := range tests {
+		lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+			records, ok := tt.records[name]
+			if !ok {
+				return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+			}
+			return records, nil
+		}
+		err := verifyDomain(context.Background(), "blog.example.com", blogID)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %v, want %v", tt.description, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDomainCache(t *testing.T) {
+	var cache domainCache
+	blogID := ulid.MustParse("01gyj3xnkr4eg6hpbr5ytg7mxh")
+	cache.set("blog.example.com", domainCacheEntry{blogID: blogID, found: true})
+	cache.set("scanner.example.com", domainCacheEntry{found: false})
+	entry, ok := cache.get("blog.example.com")
+	if !ok || !entry.found || entry.blogID != blogID {
+		t.Errorf("blog.example.com: got (%+v, %v), want the blog", entry, ok)
+	}
+	entry, ok = cache.get("scanner.example.com")
+	if !ok || entry.found {
+		t.Errorf("scanner.example.com: got (%+v, %v), want a cached miss", entry, ok)
+	}
+	_, ok = cache.get("other.example.com")
+	if ok {
+		t.Errorf("other.example.com: got a cached entry, want none")
+	}
+	for i := 0; i < maxDomainCacheSize; i++ {
+		cache.set(fmt.Sprintf("%d.example.com", i), domainCacheEntry{found: false})
+	}
+	if len(cache.entries) > maxDomainCacheSize {
+		t.Errorf("got %d entries, want at most %d", len(cache.entries), maxDomainCacheSize)
+	}
+	cache.clear()
+	_, ok = cache.get("0.example.com")
+	if ok {
+		t.Errorf("0.example.com: got a cached entry after clear, want none")
+	}
+}
@@ -0,0 +1,269 @@
+package notebrew
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// exportStaticFiles are the files in the static directory used by the pages
+// of a blog.
+var exportStaticFiles = []string{"tachyons.min.css.gz", "styles.css"}
+
+// ExportSite renders a blog as a static site that can be hosted anywhere: its
+// index page, its posts (with their approved comments, but no comment form),
+// the pages of its tags, its feeds, the images linked to from its posts and
+// the static files used by its pages. The pages link to each other with
+// relative links. The site is written to the directory output, or to a zip
+// file if output ends in ".zip". baseURL is the URL the site will be hosted
+// at, which is needed for the absolute links in the feeds.
+func (app *App) ExportSite(ctx context.Context, blogID ulid.ULID, baseURL string, output string) error {
+	if baseURL == "" {
+		return fmt.Errorf("base URL is required for the links in the feeds")
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	blog, err := app.fetchBlog(ctx, blogID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("blog %s does not exist", strings.ToLower(blogID.String()))
+		}
+		return err
+	}
+	var site siteWriter
+	if strings.HasSuffix(output, ".zip") {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		site = &zipSiteWriter{file: file, writer: zip.NewWriter(file)}
+	} else {
+		site = dirSiteWriter(output)
+	}
+
+	// The index page, at the root of the site.
+	var buf bytes.Buffer
+	err = app.renderBlogIndex(ctx, &buf, blog, siteLinks{Export: true}, false)
+	if err != nil {
+		return err
+	}
+	err = site.WriteFile("index.html", buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// The posts that are visible now, each at post/<slug>/. Posts that are
+	// scheduled to be published later are left out until the next export.
+	POST := sq.New[POST]("")
+	predicate := sq.And(
+		POST.BLOG_ID.EqUUID(blogID),
+		visiblePosts(POST),
+	)
+	posts, err := sq.FetchAllContext(ctx, app.DB, sq.
+		From(POST).
+		Where(predicate).
+		OrderBy(POST.POST_ID).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (post Post) {
+			row.UUIDField(&post.PostID, POST.POST_ID)
+			post.Blog = blog
+			post.Title = row.StringField(POST.TITLE)
+			post.Body = row.StringField(POST.BODY)
+			post.EditedAt = row.TimeField(POST.UPDATED_AT)
+			post.Status = row.StringField(POST.STATUS)
+			post.PublishAt = row.TimeField(POST.PUBLISH_AT)
+			post.Slug = row.StringField(POST.SLUG)
+			return post
+		},
+	)
+	if err != nil {
+		return err
+	}
+	err = app.fillPostTags(ctx, posts, predicate)
+	if err != nil {
+		return err
+	}
+	// The pages are rendered with the blog's theme, so the images that the
+	// theme links to are exported along with those of the posts.
+	imageIDs := make(map[ulid.ULID]bool)
+	custom, err := app.customTemplates(ctx, blogID)
+	if err != nil {
+		return err
+	}
+	for _, body := range custom {
+		addImageReferences(imageIDs, body)
+	}
+	tags := make(map[string]bool)
+	for _, post := range posts {
+		buf.Reset()
+		err = app.renderPost(ctx, &buf, post, siteLinks{Export: true, Root: "../../"}, false, nil)
+		if err != nil {
+			return err
+		}
+		err = site.WriteFile("post/"+post.Slug+"/index.html", buf.Bytes())
+		if err != nil {
+			return err
+		}
+		addImageReferences(imageIDs, post.Body)
+		for _, tag := range post.Tags {
+			tags[tag] = true
+		}
+	}
+
+	// The pages of the tags on the exported posts, each at tag/<tag>/.
+	for tag := range tags {
+		buf.Reset()
+		_, err = app.renderBlogTag(ctx, &buf, blog, tag, siteLinks{Export: true, Root: "../../"}, false)
+		if err != nil {
+			return err
+		}
+		err = site.WriteFile("tag/"+tag+"/index.html", buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	// The feeds.
+	for _, name := range []string{"feed.xml", "rss.xml"} {
+		buf.Reset()
+		_, err = app.renderBlogFeed(ctx, &buf, blog, name, siteLinks{Export: true, Root: baseURL + "/"})
+		if err != nil {
+			return err
+		}
+		err = site.WriteFile(name, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	// The images, at the same image/<imageID> paths that the posts and the
+	// theme link to.
+	IMAGE := sq.New[IMAGE]("")
+	for imageID := range imageIDs {
+		hash, err := sq.FetchOneContext(ctx, app.DB, sq.
+			From(IMAGE).
+			Where(IMAGE.IMAGE_ID.EqUUID(imageID)).
+			SetDialect(app.Dialect),
+			func(row *sq.Row) string {
+				return row.StringField(IMAGE.HASH)
+			},
+		)
+		if err != nil {
+			// A post may link to an image that has since been deleted.
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return err
+		}
+		name := hash
+		if name == "" {
+			name = strings.ToLower(imageID.String())
+		}
+		data, err := readFile(app.ImageFS, name)
+		if err != nil {
+			return err
+		}
+		err = site.WriteFile("image/"+strings.ToLower(imageID.String()), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The static files, decompressed if they are gzipped.
+	for _, name := range exportStaticFiles {
+		data, err := fs.ReadFile(rootFS, "static/"+name)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(name, ".gz") {
+			reader, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			data, err = io.ReadAll(reader)
+			if err != nil {
+				return err
+			}
+		}
+		err = site.WriteFile("static/"+strings.TrimSuffix(name, ".gz"), data)
+		if err != nil {
+			return err
+		}
+	}
+	return site.Close()
+}
+
+// readFile reads the whole of a file in fsys.
+func readFile(fsys FS, name string) ([]byte, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// siteWriter is where an exported site is written to.
+type siteWriter interface {
+	// WriteFile writes a file at the slash-separated path name.
+	WriteFile(name string, data []byte) error
+
+	// Close finishes writing the site.
+	Close() error
+}
+
+// dirSiteWriter writes a site to a directory.
+type dirSiteWriter string
+
+func (dir dirSiteWriter) WriteFile(name string, data []byte) error {
+	name = filepath.Join(string(dir), filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+func (dir dirSiteWriter) Close() error {
+	return nil
+}
+
+// zipSiteWriter writes a site to a zip file.
+type zipSiteWriter struct {
+	file   *os.File
+	writer *zip.Writer
+}
+
+func (z *zipSiteWriter) WriteFile(name string, data []byte) error {
+	w, err := z.writer.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (z *zipSiteWriter) Close() error {
+	err := z.writer.Close()
+	if err != nil {
+		return err
+	}
+	return z.file.Close()
+}
@@ -0,0 +1,292 @@
+package notebrew
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// feedSize is the number of posts in a blog's feeds.
+const feedSize = 20
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Author   atomAuthor  `xml:"author"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Links      []atomLink     `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Categories []atomCategory `xml:"category"`
+	Content    atomContent    `xml:"content"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	AtomLink      atomLink  `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// baseURL returns the URL that notebrew is served from, without a trailing
+// slash. Requests on the domain of a blog are served from that domain instead.
+func (app *App) baseURL(r *http.Request) string {
+	_, isBlogDomain := requestBlogDomain(r)
+	if app.BaseURL != "" && !isBlogDomain {
+		return app.BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// blogFeed serves the Atom (feed.xml) or RSS 2.0 (rss.xml) feed of the most
+// recently published posts of a blog.
+func (app *App) blogFeed(w http.ResponseWriter, r *http.Request, base32BlogID string, name string) {
+	if len(base32BlogID) != ulid.EncodedSize {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	if lower := strings.ToLower(base32BlogID); lower != base32BlogID {
+		http.Redirect(w, r, "/blog/"+lower+"/"+name, http.StatusMovedPermanently)
+		return
+	}
+	blogID, err := ulid.Parse(base32BlogID)
+	if err != nil {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	blog, err := app.fetchBlog(r.Context(), blogID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	links := blogLinks(r, blog.BlogIDString())
+	links.Root = app.baseURL(r)
+	updated, err := app.renderBlogFeed(r.Context(), &buf, blog, name, links)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	contentType := "application/rss+xml; charset=utf-8"
+	if name == "feed.xml" {
+		contentType = "application/atom+xml; charset=utf-8"
+	}
+	// Feeds are revalidated with the ETag (which covers changes to the blog
+	// as well as its posts) or Last-Modified, see http.ServeContent.
+	sum := sha256.Sum256(buf.Bytes())
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", updated, bytes.NewReader(buf.Bytes()))
+}
+
+// renderBlogFeed renders the Atom (feed.xml) or RSS 2.0 (rss.xml) feed of the
+// most recently published posts of a blog and returns when the feed was last
+// updated. The links in feeds must be absolute.
+func (app *App) renderBlogFeed(ctx context.Context, w io.Writer, blog Blog, name string, links siteLinks) (updated time.Time, err error) {
+	USERS := sq.New[USERS]("")
+	author, err := sq.FetchOneContext(ctx, app.DB, sq.
+		From(USERS).
+		Where(USERS.USER_ID.EqUUID(blog.UserID)).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) string {
+			return row.StringField(USERS.NAME)
+		},
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if author == "" {
+		author = blog.Title
+	}
+	POST := sq.New[POST]("")
+	predicate := sq.And(
+		POST.BLOG_ID.EqUUID(blog.BlogID),
+		visiblePosts(POST),
+	)
+	posts, err := sq.FetchAllContext(ctx, app.DB, sq.
+		From(POST).
+		Where(predicate).
+		OrderBy(POST.PUBLISH_AT.Desc(), POST.POST_ID.Desc()).
+		Limit(feedSize).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (post Post) {
+			row.UUIDField(&post.PostID, POST.POST_ID)
+			post.Title = row.StringField(POST.TITLE)
+			post.Body = row.StringField(POST.BODY)
+			post.EditedAt = row.TimeField(POST.UPDATED_AT)
+			post.Status = row.StringField(POST.STATUS)
+			post.PublishAt = row.TimeField(POST.PUBLISH_AT)
+			post.Slug = row.StringField(POST.SLUG)
+			return post
+		},
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+	err = app.fillPostTags(ctx, posts, predicate)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The feed was last updated when its newest post was published or any of
+	// its posts was edited, or when the blog was created if it has no posts.
+	updated = ulid.Time(blog.BlogID.Time())
+	for _, post := range posts {
+		if post.UpdatedAt().After(updated) {
+			updated = post.UpdatedAt()
+		}
+	}
+	blogURL := links.Blog()
+	var feed any
+	if name == "feed.xml" {
+		atom := &atomFeed{
+			ID:       blogURL,
+			Title:    blog.Title,
+			Subtitle: blog.Description,
+			Updated:  updated.UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Href: blogURL + "feed.xml", Rel: "self", Type: "application/atom+xml"},
+				{Href: blogURL, Rel: "alternate", Type: "text/html"},
+			},
+			Author: atomAuthor{Name: author},
+		}
+		for _, post := range posts {
+			postURL := links.Post(post.Slug)
+			var categories []atomCategory
+			for _, tag := range post.Tags {
+				categories = append(categories, atomCategory{Term: tag})
+			}
+			atom.Entries = append(atom.Entries, atomEntry{
+				ID:         postURN(post.PostID),
+				Title:      post.Title,
+				Links:      []atomLink{{Href: postURL, Rel: "alternate", Type: "text/html"}},
+				Published:  post.PublishedAt().UTC().Format(time.RFC3339),
+				Updated:    post.UpdatedAt().UTC().Format(time.RFC3339),
+				Categories: categories,
+				Content:    atomContent{Type: "text", Body: post.Body},
+			})
+		}
+		feed = atom
+	} else {
+		description := blog.Description
+		if description == "" {
+			description = blog.Title
+		}
+		rss := &rssFeed{
+			Version: "2.0",
+			AtomNS:  "http://www.w3.org/2005/Atom",
+			Channel: rssChannel{
+				Title:         blog.Title,
+				Link:          blogURL,
+				Description:   description,
+				AtomLink:      atomLink{Href: blogURL + "rss.xml", Rel: "self", Type: "application/rss+xml"},
+				LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+			},
+		}
+		for _, post := range posts {
+			postURL := links.Post(post.Slug)
+			rss.Channel.Items = append(rss.Channel.Items, rssItem{
+				Title:      post.Title,
+				Link:       postURL,
+				GUID:       rssGUID{IsPermaLink: false, Value: postURN(post.PostID)},
+				PubDate:    post.PublishedAt().UTC().Format(time.RFC1123Z),
+				Categories: post.Tags,
+				// RSS descriptions are HTML, so the plain text body
+				// is escaped as HTML before it is escaped as XML.
+				Description: "<p style=\"white-space: pre-wrap\">" + html.EscapeString(post.Body) + "</p>",
+			})
+		}
+		feed = rss
+	}
+	_, err = io.WriteString(w, xml.Header)
+	if err != nil {
+		return time.Time{}, err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(feed)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return updated, nil
+}
+
+// postURN returns the ID of a post in feeds. Feed readers tell entries apart
+// by their ID, so it is derived from the post ID rather than the URL of the
+// post, which changes along with its slug.
+func postURN(postID ulid.ULID) string {
+	id := hex.EncodeToString(postID[:])
+	return "urn:uuid:" + id[:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:]
+}
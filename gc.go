@@ -0,0 +1,279 @@
+package notebrew
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// imageReferenceRegexp matches the links to images in note and post bodies,
+// and in the templates of blog themes.
+var imageReferenceRegexp = regexp.MustCompile(`/image/([0-9A-Za-z]{26})`)
+
+// GarbageReport lists the orphaned images and files found by
+// CollectGarbage.
+type GarbageReport struct {
+	// Images are the IDs of the images that are not referenced by any
+	// note, post or theme template.
+	Images []string
+
+	// Files are the names of the files in the ImageFS that don't belong to
+	// any image.
+	Files []string
+}
+
+// CollectGarbage finds the images that are no longer referenced by any note,
+// post or theme template (including the notes in the trash and past revisions
+// of notes, which can still be restored), and the files in the ImageFS that no
+// image refers to, such as those left behind by an interrupted upload. Only
+// images and files older than gracePeriod are considered, so that an image
+// that was just uploaded isn't collected before the note that uses it has been
+// saved. The orphans are deleted unless dryRun is true. Each image is checked
+// for links again in the transaction that deletes it, so an image that is
+// linked to while the collector runs is kept.
+func (app *App) CollectGarbage(ctx context.Context, gracePeriod time.Duration, dryRun bool) (GarbageReport, error) {
+	var report GarbageReport
+	cutoff := time.Now().Add(-gracePeriod)
+
+	// Mark every image linked to from a note or post body, or from a theme.
+	referenced := make(map[ulid.ULID]bool)
+	for _, source := range imageReferenceSources() {
+		err := app.markImageReferences(ctx, referenced, source.table, source.body)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// Sweep the images that weren't marked.
+	type Image struct {
+		ImageID ulid.ULID
+		UserID  ulid.ULID
+	}
+	IMAGE := sq.New[IMAGE]("")
+	images, err := sq.FetchAllContext(ctx, app.DB, sq.
+		From(IMAGE).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (image Image) {
+			row.UUIDField(&image.ImageID, IMAGE.IMAGE_ID)
+			row.UUIDField(&image.UserID, IMAGE.USER_ID)
+			return image
+		},
+	)
+	if err != nil {
+		return report, err
+	}
+	for _, image := range images {
+		if referenced[image.ImageID] || !ulid.Time(image.ImageID.Time()).Before(cutoff) {
+			continue
+		}
+		if dryRun {
+			report.Images = append(report.Images, strings.ToLower(image.ImageID.String()))
+			continue
+		}
+		// The image may have been linked to since it was marked, which
+		// deleteImage checks again before deleting it.
+		err = app.deleteImage(ctx, image.UserID, image.ImageID, true)
+		if err != nil {
+			if errors.Is(err, errImageReferenced) {
+				continue
+			}
+			return report, err
+		}
+		report.Images = append(report.Images, strings.ToLower(image.ImageID.String()))
+	}
+
+	// Sweep the files that don't belong to any image. This is done after
+	// deleting the orphaned images so that the files they leave behind (if
+	// any) are collected as well.
+	IMAGE_BLOB := sq.New[IMAGE_BLOB]("")
+	names := make(map[string]bool)
+	// A blob without references is only left behind if deleteImage failed
+	// to remove its files, which are collected here instead.
+	hashes, err := sq.FetchAllContext(ctx, app.DB, sq.
+		From(IMAGE_BLOB).
+		Where(IMAGE_BLOB.REF_COUNT.GtInt(0)).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) string {
+			return row.StringField(IMAGE_BLOB.HASH)
+		},
+	)
+	if err != nil {
+		return report, err
+	}
+	for _, hash := range hashes {
+		names[hash] = true
+	}
+	// Images uploaded before deduplication have their files stored under
+	// their own ID.
+	imageIDs, err := sq.FetchAllContext(ctx, app.DB, sq.
+		From(IMAGE).
+		Where(IMAGE.HASH.IsNull()).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (imageID ulid.ULID) {
+			row.UUIDField(&imageID, IMAGE.IMAGE_ID)
+			return imageID
+		},
+	)
+	if err != nil {
+		return report, err
+	}
+	for _, imageID := range imageIDs {
+		names[strings.ToLower(imageID.String())] = true
+	}
+	entries, err := app.ImageFS.ReadDir(".")
+	if err != nil {
+		return report, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		// Only files named like an image's files are considered, so that
+		// nothing else stored alongside them (such as other objects in the
+		// same S3 bucket) is ever deleted.
+		baseName, ok := imageFileBaseName(name)
+		if !ok || names[baseName] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return report, err
+		}
+		if !info.ModTime().Before(cutoff) {
+			continue
+		}
+		report.Files = append(report.Files, name)
+		if dryRun {
+			continue
+		}
+		err = app.ImageFS.Remove(name)
+		if err != nil {
+			return report, err
+		}
+	}
+	// Sweep the temporary files left behind by writes that never finished.
+	if tempFS, ok := app.ImageFS.(interface {
+		removeTempFiles(cutoff time.Time, dryRun bool) ([]string, error)
+	}); ok {
+		tempFiles, err := tempFS.removeTempFiles(cutoff, dryRun)
+		report.Files = append(report.Files, tempFiles...)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// imageFileBaseName returns the name of the image that the named file in the
+// ImageFS belongs to, which is either a lowercase image ID (for images
+// uploaded before deduplication) or the hex SHA-256 hash of the image's
+// contents. Variants are named <name>-<width>. It returns false if the file
+// isn't named like an image's file.
+func imageFileBaseName(name string) (string, bool) {
+	baseName := name
+	if i := strings.IndexByte(name, '-'); i >= 0 {
+		baseName = name[:i]
+		width := name[i+1:]
+		if width == "" || strings.Trim(width, "0123456789") != "" {
+			return "", false
+		}
+	}
+	switch len(baseName) {
+	case ulid.EncodedSize:
+		_, err := ulid.ParseStrict(baseName)
+		if err != nil || strings.ToLower(baseName) != baseName {
+			return "", false
+		}
+	case hex.EncodedLen(sha256.Size):
+		if strings.Trim(baseName, "0123456789abcdef") != "" {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	return baseName, true
+}
+
+// imageReferenceSource is a table with a column that can link to images.
+type imageReferenceSource struct {
+	table sq.Table
+	body  sq.StringField
+}
+
+// imageReferenceSources returns the tables and columns that can link to
+// images: the bodies of notes, their revisions and posts, and the templates of
+// themes.
+func imageReferenceSources() []imageReferenceSource {
+	NOTE := sq.New[NOTE]("")
+	NOTE_REVISION := sq.New[NOTE_REVISION]("")
+	POST := sq.New[POST]("")
+	BLOG_TEMPLATE := sq.New[BLOG_TEMPLATE]("")
+	return []imageReferenceSource{
+		{NOTE, NOTE.BODY},
+		{NOTE_REVISION, NOTE_REVISION.BODY},
+		{POST, POST.BODY},
+		{BLOG_TEMPLATE, BLOG_TEMPLATE.BODY},
+	}
+}
+
+// imageReferenced reports whether any of the imageReferenceSources links to
+// an image.
+func (app *App) imageReferenced(ctx context.Context, tx *sql.Tx, imageID ulid.ULID) (bool, error) {
+	pattern := "%/image/" + strings.ToLower(imageID.String()) + "%"
+	for _, source := range imageReferenceSources() {
+		referenced, err := sq.FetchExistsContext(ctx, tx, sq.
+			SelectOne().
+			From(source.table).
+			Where(sq.Expr("LOWER({}) LIKE {}", source.body, pattern)).
+			SetDialect(app.Dialect),
+		)
+		if err != nil {
+			return false, err
+		}
+		if referenced {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// markImageReferences adds the IDs of the images linked to from the body
+// column of every row in table to referenced.
+func (app *App) markImageReferences(ctx context.Context, referenced map[ulid.ULID]bool, table sq.Table, body sq.StringField) error {
+	cursor, err := sq.FetchCursorContext(ctx, app.DB, sq.
+		From(table).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) string {
+			return row.StringField(body)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	for cursor.Next() {
+		body, err := cursor.Result()
+		if err != nil {
+			return err
+		}
+		addImageReferences(referenced, body)
+	}
+	return cursor.Close()
+}
+
+// addImageReferences adds the IDs of the images linked to from s to imageIDs.
+func addImageReferences(imageIDs map[ulid.ULID]bool, s string) {
+	for _, match := range imageReferenceRegexp.FindAllStringSubmatch(s, -1) {
+		imageID, err := ulid.Parse(match[1])
+		if err != nil {
+			continue
+		}
+		imageIDs[imageID] = true
+	}
+}
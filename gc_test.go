@@ -0,0 +1,94 @@
+package notebrew
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestImageFileBaseName(t *testing.T) {
+	type TestTable struct {
+		name         string
+		wantBaseName string
+		wantOK       bool
+	}
+
+	const hash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []TestTable{
+		{name: "01gyj3xnkr4eg6hpbr5ytg7mxh", wantBaseName: "01gyj3xnkr4eg6hpbr5ytg7mxh", wantOK: true},
+		{name: "01gyj3xnkr4eg6hpbr5ytg7mxh-640", wantBaseName: "01gyj3xnkr4eg6hpbr5ytg7mxh", wantOK: true},
+		{name: hash, wantBaseName: hash, wantOK: true},
+		{name: hash + "-1280", wantBaseName: hash, wantOK: true},
+		{name: "01GYJ3XNKR4EG6HPBR5YTG7MXH", wantOK: false},
+		{name: "01gyj3xnkr4eg6hpbr5ytg7mx", wantOK: false},
+		{name: "81gyj3xnkr4eg6hpbr5ytg7mxh", wantOK: false},
+		{name: hash[:63] + "g", wantOK: false},
+		{name: hash + "-", wantOK: false},
+		{name: hash + "-640-1", wantOK: false},
+		{name: hash + "-wide", wantOK: false},
+		{name: "backups/notebrew.db", wantOK: false},
+		{name: "", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		gotBaseName, gotOK := imageFileBaseName(tt.name)
+		if gotBaseName != tt.wantBaseName || gotOK != tt.wantOK {
+			t.Errorf("%q: got (%q, %v), want (%q, %v)", tt.name, gotBaseName, gotOK, tt.wantBaseName, tt.wantOK)
+		}
+	}
+}
+
+func TestDirFSRemoveTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	files := []struct {
+		path    string
+		modTime time.Time
+	}{
+		{"mx/.01gyj3xnkr4eg6hpbr5ytg7mxh.123.tmp", old},
+		{"mx/.01gyj3xnkr4eg6hpbr5ytg7mxh.456.tmp", time.Now()},
+		{"mx/01gyj3xnkr4eg6hpbr5ytg7mxh", old},
+		{".keep", old},
+	}
+	for _, file := range files {
+		filePath := filepath.Join(dir, file.path)
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filePath, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(filePath, file.modTime, file.modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fsys := NestedDirFS(dir).(dirFS)
+	cutoff := time.Now().Add(-24 * time.Hour)
+	wantNames := []string{".01gyj3xnkr4eg6hpbr5ytg7mxh.123.tmp"}
+	gotNames, err := fsys.removeTempFiles(cutoff, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotNames, wantNames) {
+		t.Fatalf("dry run: got %q, want %q", gotNames, wantNames)
+	}
+	gotNames, err = fsys.removeTempFiles(cutoff, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotNames, wantNames) {
+		t.Fatalf("got %q, want %q", gotNames, wantNames)
+	}
+	for i, file := range files {
+		_, err := os.Stat(filepath.Join(dir, file.path))
+		if removed := os.IsNotExist(err); removed != (i == 0) {
+			t.Errorf("%s: removed is %v", file.path, removed)
+		}
+	}
+}
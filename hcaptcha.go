@@ -0,0 +1,71 @@
+package notebrew
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// hCaptchaVerifyURL is where the responses to hCaptcha challenges are
+// verified.
+const hCaptchaVerifyURL = "https://hcaptcha.com/siteverify"
+
+// hCaptchaClient is the HTTP client that verifies hCaptcha responses. Unlike
+// http.DefaultClient it has a timeout, so that a slow hCaptcha can't hold up
+// registrations and anonymous comments forever.
+var hCaptchaClient = &http.Client{Timeout: 10 * time.Second}
+
+type hCaptchaVerificationResult struct {
+	// From https://docs.hcaptcha.com/
+	// {
+	//    "success": true|false,     // is the passcode valid, and does it meet security criteria you specified, e.g. sitekey?
+	//    "challenge_ts": timestamp, // timestamp of the challenge (ISO format yyyy-MM-dd'T'HH:mm:ssZZ)
+	//    "hostname": string,        // the hostname of the site where the challenge was solved
+	//    "credit": true|false,      // optional: whether the response will be credited
+	//    "error-codes": [...]       // optional: any error codes
+	//    "score": float,            // ENTERPRISE feature: a score denoting malicious activity.
+	//    "score_reason": [...]      // ENTERPRISE feature: reason(s) for score.
+	// }
+	Success     bool   `json:"success"`
+	ChallengeTs string `json:"challenge_ts"`
+	Hostname    string `json:"hostname"`
+	Credit      bool   `json:"credit"`
+	ErrorCodes  []any  `json:"error-codes"`
+}
+
+// verifyHCaptcha checks with hCaptcha whether the response to an hCaptcha
+// challenge is valid. The hCaptcha widget submits the response in the
+// h-captcha-response form field.
+func (app *App) verifyHCaptcha(ctx context.Context, response string) (bool, error) {
+	if response == "" {
+		return false, nil
+	}
+	form := url.Values{
+		"secret":   []string{app.HCaptchaSecret},
+		"response": []string{response},
+		"sitekey":  []string{app.HCaptchaSiteKey},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", hCaptchaVerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := hCaptchaClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("hcaptcha: %s", resp.Status)
+	}
+	var verificationResult hCaptchaVerificationResult
+	err = json.NewDecoder(resp.Body).Decode(&verificationResult)
+	if err != nil {
+		return false, err
+	}
+	return verificationResult.Success, nil
+}
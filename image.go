@@ -0,0 +1,710 @@
+package notebrew
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// maxImageSize is the maximum size of an uploaded image.
+const maxImageSize = 10 << 20
+
+// imagesPerPage is the number of images listed on /image/.
+const imagesPerPage = 100
+
+// imageContentTypes are the content types (as sniffed by
+// http.DetectContentType) of the images that may be uploaded.
+var imageContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func (app *App) Image(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		app.Error(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/")
+	if segments[0] != "image" || len(segments) > 3 {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	if len(segments) == 3 {
+		if segments[2] != "delete" {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		if r.Method != "POST" {
+			app.Error(w, r, http.StatusMethodNotAllowed, nil)
+			return
+		}
+	}
+
+	// Images are served to anyone who has the link, so that they can be
+	// embedded anywhere.
+	if len(segments) == 2 {
+		if r.Method != "GET" {
+			app.Error(w, r, http.StatusMethodNotAllowed, nil)
+			return
+		}
+		app.serveImage(w, r, segments[1])
+		return
+	}
+
+	currentUserID, loggedIn := app.CurrentUserID(r)
+	if !loggedIn {
+		app.Redirect(w, r, "/login", map[string]string{
+			"RedirectTo": r.URL.Path,
+		})
+		return
+	}
+
+	if len(segments) == 3 {
+		imageID, err := ulid.Parse(segments[1])
+		if err != nil {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		err = app.deleteImage(r.Context(), currentUserID, imageID, false)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				app.Error(w, r, http.StatusNotFound, nil)
+				return
+			}
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, r, "/image/", http.StatusFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		app.imageList(w, r, currentUserID)
+		return
+	}
+
+	// Upload an image.
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+(1<<20))
+	reader, err := r.MultipartReader()
+	if err != nil {
+		app.Error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var part io.Reader
+	for {
+		p, err := reader.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			app.Error(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if p.FormName() == "image" {
+			part = p
+			break
+		}
+	}
+	if part == nil {
+		app.Error(w, r, http.StatusBadRequest, "missing image")
+		return
+	}
+	// Read the whole image into memory (up to maxImageSize) so that it is
+	// validated before anything is written to the ImageFS.
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(part, maxImageSize+1))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			app.Error(w, r, http.StatusRequestEntityTooLarge, nil)
+			return
+		}
+		app.Error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if n > maxImageSize {
+		app.Error(w, r, http.StatusRequestEntityTooLarge, nil)
+		return
+	}
+	contentType := http.DetectContentType(buf.Bytes())
+	if !imageContentTypes[contentType] {
+		app.Error(w, r, http.StatusUnsupportedMediaType, "unsupported image type "+contentType)
+		return
+	}
+	data := buf.Bytes()
+	var img image.Image
+	var config image.Config
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		config, _, err = image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			app.Error(w, r, http.StatusUnsupportedMediaType, err)
+			return
+		}
+		if config.Width*config.Height > maxImagePixels {
+			app.Error(w, r, http.StatusRequestEntityTooLarge, "image dimensions are too large")
+			return
+		}
+		if imageVariantFormats[contentType] {
+			// Photos may contain the location where they were taken, which
+			// must not be published along with the image.
+			data, err = stripImageMetadata(contentType, data)
+			if err != nil {
+				app.Error(w, r, http.StatusUnsupportedMediaType, err)
+				return
+			}
+			img, _, err = image.Decode(bytes.NewReader(data))
+			if err != nil {
+				app.Error(w, r, http.StatusUnsupportedMediaType, err)
+				return
+			}
+			// Baking in the EXIF orientation may have swapped the width and
+			// height.
+			bounds := img.Bounds()
+			config.Width, config.Height = bounds.Dx(), bounds.Dy()
+		}
+	}
+	imageID, err := app.storeImage(r.Context(), currentUserID, uploadedImage{
+		ContentType: contentType,
+		Data:        data,
+		Image:       img,
+		Width:       config.Width,
+		Height:      config.Height,
+	})
+	if err != nil {
+		if isQuotaError(err) {
+			app.Error(w, r, http.StatusInsufficientStorage, err)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	name := strings.ToLower(imageID.String())
+	imageURL := "/image/" + name
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", imageURL)
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(map[string]string{
+			"imageID": name,
+			"url":     imageURL,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	http.Redirect(w, r, "/image/", http.StatusFound)
+}
+
+// uploadedImage is an uploaded image that has been validated and stripped
+// of its metadata.
+type uploadedImage struct {
+	ContentType string
+	Data        []byte
+	// Image is the decoded image, or nil if no variants are generated for
+	// images of its content type.
+	Image image.Image
+	// Width and Height are 0 if the dimensions of the image are unknown.
+	Width  int
+	Height int
+}
+
+// storeImage records a new image owned by userID and returns its ID. The
+// files of an image are named after the SHA-256 hash of its contents and
+// reference counted in the IMAGE_BLOB table, so uploading an image that is
+// already stored only adds a reference to the existing files.
+func (app *App) storeImage(ctx context.Context, userID ulid.ULID, upload uploadedImage) (ulid.ULID, error) {
+	sum := sha256.Sum256(upload.Data)
+	hash := hex.EncodeToString(sum[:])
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	defer tx.Rollback()
+	// Every image counts towards its owner's quota in full, even if its
+	// files are shared with other images.
+	err = app.updateUsage(ctx, tx, userID, Quota{ImageBytes: int64(len(upload.Data))})
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	// Adding the reference locks the blob's row until the transaction ends,
+	// so deleteImage can't remove the files from under us.
+	IMAGE_BLOB := sq.New[IMAGE_BLOB]("")
+	insertQuery := sq.InsertQuery{
+		Dialect:     app.Dialect,
+		InsertTable: IMAGE_BLOB,
+		ColumnMapper: func(col *sq.Column) {
+			col.SetString(IMAGE_BLOB.HASH, hash)
+			col.SetInt(IMAGE_BLOB.REF_COUNT, 1)
+		},
+	}
+	switch app.Dialect {
+	case sq.DialectSQLite, sq.DialectPostgres:
+		insertQuery.Conflict.Fields = sq.Fields{IMAGE_BLOB.HASH}
+		insertQuery.Conflict.Resolution = sq.Assignments{
+			IMAGE_BLOB.REF_COUNT.Setf("{} + 1", IMAGE_BLOB.REF_COUNT),
+		}
+	case sq.DialectMySQL:
+		insertQuery.RowAlias = "new"
+		insertQuery.Conflict.Resolution = sq.Assignments{
+			IMAGE_BLOB.REF_COUNT.Setf("{} + 1", IMAGE_BLOB.REF_COUNT),
+		}
+	}
+	_, err = sq.ExecContext(ctx, tx, insertQuery)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	refCount, err := sq.FetchOneContext(ctx, tx, sq.
+		From(IMAGE_BLOB).
+		Where(IMAGE_BLOB.HASH.EqString(hash)).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) int {
+			return row.IntField(IMAGE_BLOB.REF_COUNT)
+		},
+	)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	if refCount == 1 {
+		// Nobody else has uploaded this image, write its files.
+		err = writeImageFile(app.ImageFS, hash, upload.Data)
+		if err == nil && upload.Image != nil {
+			err = writeImageVariants(app.ImageFS, hash, upload.ContentType, upload.Image)
+		}
+		if err != nil {
+			removeErr := removeImageFiles(app.ImageFS, hash)
+			if removeErr != nil {
+				log.Println(removeErr)
+			}
+			return ulid.ULID{}, err
+		}
+	}
+	imageID := ulid.Make()
+	IMAGE := sq.New[IMAGE]("")
+	_, err = sq.ExecContext(ctx, tx, sq.
+		InsertInto(IMAGE).
+		ColumnValues(func(col *sq.Column) {
+			col.SetUUID(IMAGE.IMAGE_ID, imageID)
+			col.SetUUID(IMAGE.USER_ID, userID)
+			col.SetString(IMAGE.CONTENT_TYPE, upload.ContentType)
+			col.SetString(IMAGE.HASH, hash)
+			col.SetInt64(IMAGE.SIZE, int64(len(upload.Data)))
+			// webp images can't be decoded with the standard library, so
+			// their dimensions are unknown.
+			if upload.Width > 0 {
+				col.SetInt(IMAGE.WIDTH, upload.Width)
+				col.SetInt(IMAGE.HEIGHT, upload.Height)
+			}
+		}).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	return imageID, tx.Commit()
+}
+
+// errImageReferenced is returned by deleteImage for an image that is still
+// linked to.
+var errImageReferenced = errors.New("image is still linked to")
+
+// deleteImage deletes an image owned by userID. Its files are removed once no
+// other image refers to them. It returns sql.ErrNoRows if the user has no
+// such image. If orphanedOnly is true, the image is only deleted if nothing
+// links to it (see imageReferenced), which is checked in the same transaction
+// as the delete; otherwise it returns errImageReferenced.
+func (app *App) deleteImage(ctx context.Context, userID ulid.ULID, imageID ulid.ULID, orphanedOnly bool) error {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if orphanedOnly {
+		referenced, err := app.imageReferenced(ctx, tx, imageID)
+		if err != nil {
+			return err
+		}
+		if referenced {
+			return errImageReferenced
+		}
+	}
+	IMAGE := sq.New[IMAGE]("")
+	image, err := sq.FetchOneContext(ctx, tx, sq.
+		From(IMAGE).
+		Where(
+			IMAGE.IMAGE_ID.EqUUID(imageID),
+			IMAGE.USER_ID.EqUUID(userID),
+		).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (image struct {
+			Hash string
+			Size int64
+		}) {
+			image.Hash = row.StringField(IMAGE.HASH)
+			image.Size = row.Int64Field(IMAGE.SIZE)
+			return image
+		},
+	)
+	if err != nil {
+		return err
+	}
+	hash := image.Hash
+	_, err = sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(IMAGE).
+		Where(IMAGE.IMAGE_ID.EqUUID(imageID)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	err = app.updateUsage(ctx, tx, userID, Quota{ImageBytes: -image.Size})
+	if err != nil {
+		return err
+	}
+	// Images uploaded before deduplication have their files stored under
+	// their own ID.
+	if hash == "" {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		return removeImageFiles(app.ImageFS, strings.ToLower(imageID.String()))
+	}
+	IMAGE_BLOB := sq.New[IMAGE_BLOB]("")
+	_, err = sq.ExecContext(ctx, tx, sq.
+		Update(IMAGE_BLOB).
+		Set(IMAGE_BLOB.REF_COUNT.Setf("{} - 1", IMAGE_BLOB.REF_COUNT)).
+		Where(IMAGE_BLOB.HASH.EqString(hash)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	refCount, err := sq.FetchOneContext(ctx, tx, sq.
+		From(IMAGE_BLOB).
+		Where(IMAGE_BLOB.HASH.EqString(hash)).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) int {
+			return row.IntField(IMAGE_BLOB.REF_COUNT)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if refCount > 0 {
+		return nil
+	}
+	return app.removeImageBlob(ctx, hash)
+}
+
+// removeImageBlob removes the files of the blob identified by hash and its row
+// in the IMAGE_BLOB table, provided that no image has referred to the blob
+// since its reference count dropped to zero.
+//
+// The files are only removed after the last reference to them has been
+// committed, so that a failed commit can't leave an image without its files.
+// The row is kept (with a reference count of zero) until the files are gone
+// and is locked while they are being removed, so that a concurrent upload of
+// the same image either waits for us and writes the files again, or adds its
+// reference first and keeps us from removing them.
+func (app *App) removeImageBlob(ctx context.Context, hash string) error {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	IMAGE_BLOB := sq.New[IMAGE_BLOB]("")
+	// A no-op update locks the row.
+	_, err = sq.ExecContext(ctx, tx, sq.
+		Update(IMAGE_BLOB).
+		Set(IMAGE_BLOB.REF_COUNT.Setf("{}", IMAGE_BLOB.REF_COUNT)).
+		Where(IMAGE_BLOB.HASH.EqString(hash)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	unreferenced, err := sq.FetchExistsContext(ctx, tx, sq.
+		SelectOne().
+		From(IMAGE_BLOB).
+		Where(
+			IMAGE_BLOB.HASH.EqString(hash),
+			IMAGE_BLOB.REF_COUNT.LeInt(0),
+		).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	if !unreferenced {
+		return nil
+	}
+	err = removeImageFiles(app.ImageFS, hash)
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(IMAGE_BLOB).
+		Where(IMAGE_BLOB.HASH.EqString(hash)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// imageVariantWidths are the widths of the resized variants generated for
+// every uploaded image that is wider than them.
+var imageVariantWidths = []int{320, 800, 1600}
+
+// imageVariantFormats are the content types of the images that resized
+// variants are generated for. GIFs are left alone because they may be
+// animated, and the standard library can't decode webp.
+var imageVariantFormats = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// maxImagePixels is the maximum number of pixels in an uploaded image. It
+// stops small files from decoding into huge images: decoding an image and
+// converting it to RGBA for resizing takes around 8 bytes per pixel, so an
+// upload at the limit still needs about 200MB of memory.
+const maxImagePixels = 24_000_000
+
+// imageVariantName returns the name in the ImageFS of the variant of the
+// image with the given width.
+func imageVariantName(name string, width int) string {
+	return name + "-" + strconv.Itoa(width)
+}
+
+// writeImageVariants writes a resized copy of img to fsys for each of the
+// imageVariantWidths narrower than img, re-encoded in the same format as the
+// original.
+func writeImageVariants(fsys FS, name string, contentType string, img image.Image) error {
+	var buf bytes.Buffer
+	for _, width := range imageVariantWidths {
+		if width >= img.Bounds().Dx() {
+			break
+		}
+		variant := resizeImage(img, width)
+		buf.Reset()
+		var err error
+		switch contentType {
+		case "image/jpeg":
+			err = jpeg.Encode(&buf, variant, &jpeg.Options{Quality: 80})
+		case "image/png":
+			err = png.Encode(&buf, variant)
+		}
+		if err != nil {
+			return err
+		}
+		err = writeImageFile(fsys, imageVariantName(name, width), buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeImageFile writes data to the file with the given name in fsys.
+func writeImageFile(fsys FS, name string, data []byte) error {
+	writer, err := fsys.OpenWriter(name)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// removeImageFiles removes an image and all of its variants from fsys.
+// Files that do not exist are skipped.
+func removeImageFiles(fsys FS, name string) error {
+	names := []string{name}
+	for _, width := range imageVariantWidths {
+		names = append(names, imageVariantName(name, width))
+	}
+	for _, name := range names {
+		err := fsys.Remove(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveImage serves the image identified by base32ImageID. If the w query
+// parameter is present, the smallest variant of the image that is at least w
+// pixels wide is served instead (or the original if there is none).
+func (app *App) serveImage(w http.ResponseWriter, r *http.Request, base32ImageID string) {
+	if len(base32ImageID) != ulid.EncodedSize {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	// Images are stored under their lowercase ID.
+	if name := strings.ToLower(base32ImageID); name != base32ImageID {
+		u := *r.URL
+		u.Path = "/image/" + name
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	imageID, err := ulid.Parse(base32ImageID)
+	if err != nil {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	IMAGE := sq.New[IMAGE]("")
+	result, err := sq.FetchOneContext(r.Context(), app.DB, sq.
+		From(IMAGE).
+		Where(IMAGE.IMAGE_ID.EqUUID(imageID)).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (result struct {
+			ContentType string
+			Width       int
+			Hash        string
+		}) {
+			result.ContentType = row.StringField(IMAGE.CONTENT_TYPE)
+			result.Width = row.IntField(IMAGE.WIDTH)
+			result.Hash = row.StringField(IMAGE.HASH)
+			return result
+		},
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// Images uploaded before deduplication have their files stored under
+	// their own ID.
+	baseName := result.Hash
+	if baseName == "" {
+		baseName = base32ImageID
+	}
+	name := baseName
+	query := r.URL.Query()
+	if query.Has("w") && imageVariantFormats[result.ContentType] {
+		width, err := strconv.Atoi(query.Get("w"))
+		if err != nil || width <= 0 {
+			app.Error(w, r, http.StatusBadRequest, "invalid w")
+			return
+		}
+		for _, variantWidth := range imageVariantWidths {
+			if variantWidth >= result.Width {
+				break
+			}
+			if variantWidth >= width {
+				name = imageVariantName(baseName, variantWidth)
+				break
+			}
+		}
+	}
+	file, err := app.ImageFS.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer file.Close()
+	// An image never changes once uploaded, so it can be cached forever.
+	w.Header().Set("Content-Type", result.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+name+`"`)
+	modTime := ulid.Time(imageID.Time())
+	fileseeker, ok := file.(io.ReadSeeker)
+	if ok {
+		http.ServeContent(w, r, "", modTime, fileseeker)
+		return
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(file)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(buf.Bytes()))
+}
+
+// imageList renders the upload form and the images uploaded by the user,
+// newest first.
+func (app *App) imageList(w http.ResponseWriter, r *http.Request, userID ulid.ULID) {
+	type Image struct {
+		ImageID    string
+		UploadedAt time.Time
+	}
+	IMAGE := sq.New[IMAGE]("")
+	images, err := sq.FetchAllContext(r.Context(), app.DB, sq.
+		From(IMAGE).
+		Where(IMAGE.USER_ID.EqUUID(userID)).
+		OrderBy(IMAGE.IMAGE_ID.Desc()).
+		Limit(imagesPerPage).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) Image {
+			var imageID ulid.ULID
+			row.UUIDField(&imageID, IMAGE.IMAGE_ID)
+			return Image{
+				ImageID:    strings.ToLower(imageID.String()),
+				UploadedAt: ulid.Time(imageID.Time()),
+			}
+		},
+	)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	tmpl, err := template.ParseFiles("html/images.html")
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]any{
+		"Images": images,
+	})
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,253 @@
+package notebrew
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+// stripImageMetadata removes the metadata (EXIF, XMP, IPTC, comments and
+// text chunks) from a JPEG or PNG image, which may contain things like the
+// GPS coordinates of where a photo was taken. If the image has an EXIF
+// orientation, the image is rotated accordingly and re-encoded so that it
+// still displays the right way up without it. Other content types are
+// returned unchanged.
+func stripImageMetadata(contentType string, data []byte) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		stripped, orientation, err := stripJPEGMetadata(data)
+		if err != nil {
+			return nil, err
+		}
+		if orientation <= 1 {
+			return stripped, nil
+		}
+		img, err := jpeg.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = jpeg.Encode(&buf, orientImage(img, orientation), &jpeg.Options{Quality: 90})
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "image/png":
+		stripped, orientation, err := stripPNGMetadata(data)
+		if err != nil {
+			return nil, err
+		}
+		if orientation <= 1 {
+			return stripped, nil
+		}
+		img, err := png.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = png.Encode(&buf, orientImage(img, orientation))
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return data, nil
+}
+
+var errInvalidJPEG = errors.New("invalid JPEG")
+
+// stripJPEGMetadata removes the metadata segments from a JPEG without
+// re-encoding it, and returns the EXIF orientation of the image (or 0 if it
+// has none). The segments needed to display the image correctly (the JFIF
+// header, ICC color profiles and the Adobe color transform) are kept.
+func stripJPEGMetadata(data []byte) (stripped []byte, orientation int, err error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errInvalidJPEG
+	}
+	buf := make([]byte, 0, len(data))
+	buf = append(buf, data[:2]...)
+	i := 2
+	for {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, 0, errInvalidJPEG
+		}
+		marker := data[i+1]
+		// Markers may be preceded by any number of 0xFF fill bytes.
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		// Start of scan: the compressed image data follows, and everything
+		// after it is kept as-is.
+		if marker == 0xDA {
+			buf = append(buf, data[i:]...)
+			return buf, orientation, nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, 0, errInvalidJPEG
+		}
+		segment := data[i : i+2+length]
+		payload := segment[4:]
+		keep := true
+		switch {
+		case marker == 0xE1: // APP1: EXIF or XMP
+			if bytes.HasPrefix(payload, []byte("Exif\x00\x00")) && orientation == 0 {
+				orientation = exifOrientation(payload[6:])
+			}
+			keep = false
+		case marker == 0xE2: // APP2: ICC profile or FlashPix
+			keep = bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+		case marker == 0xE0 || marker == 0xEE: // APP0 (JFIF) and APP14 (Adobe)
+			keep = true
+		case 0xE3 <= marker && marker <= 0xEF: // other APPn, including IPTC
+			keep = false
+		case marker == 0xFE: // COM
+			keep = false
+		}
+		if keep {
+			buf = append(buf, segment...)
+		}
+		i += 2 + length
+	}
+}
+
+var errInvalidPNG = errors.New("invalid PNG")
+
+// pngSignature is the first eight bytes of every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngMetadataChunks are the types of the PNG chunks removed by
+// stripPNGMetadata.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata removes the metadata chunks from a PNG without
+// re-encoding it, and returns the EXIF orientation of the image (or 0 if it
+// has none).
+func stripPNGMetadata(data []byte) (stripped []byte, orientation int, err error) {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return nil, 0, errInvalidPNG
+	}
+	buf := make([]byte, 0, len(data))
+	buf = append(buf, pngSignature...)
+	i := len(pngSignature)
+	for i < len(data) {
+		// Each chunk is a 4 byte length, a 4 byte type, the data and a 4
+		// byte CRC.
+		if i+8 > len(data) {
+			return nil, 0, errInvalidPNG
+		}
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		if length < 0 || i+12+length > len(data) {
+			return nil, 0, errInvalidPNG
+		}
+		chunkType := string(data[i+4 : i+8])
+		chunk := data[i : i+12+length]
+		if chunkType == "eXIf" && orientation == 0 {
+			// Only trust the orientation if the chunk isn't corrupted.
+			if crc32.ChecksumIEEE(chunk[4:8+length]) == binary.BigEndian.Uint32(chunk[8+length:]) {
+				orientation = exifOrientation(chunk[8 : 8+length])
+			}
+		}
+		if !pngMetadataChunks[chunkType] {
+			buf = append(buf, chunk...)
+		}
+		i += 12 + length
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return buf, orientation, nil
+}
+
+// exifOrientation returns the value of the orientation tag in the first IFD
+// of the EXIF data (a TIFF structure), or 0 if there is none.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		tag := order.Uint16(tiff[entry : entry+2])
+		typ := order.Uint16(tiff[entry+2 : entry+4])
+		// The orientation is a single SHORT, stored in the first two bytes
+		// of the value field.
+		if tag == 0x0112 && typ == 3 {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation < 1 || orientation > 8 {
+				return 0
+			}
+			return orientation
+		}
+	}
+	return 0
+}
+
+// orientImage transforms img according to an EXIF orientation so that it
+// displays the right way up without the orientation tag.
+func orientImage(img image.Image, orientation int) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Rect, img, bounds.Min, draw.Src)
+	// Orientations 5 to 8 swap the width and height.
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			// (sx, sy) is the source pixel that ends up at (x, y).
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = width-1-x, y
+			case 3: // rotated 180°
+				sx, sy = width-1-x, height-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, height-1-y
+			case 5: // mirrored along the top-left to bottom-right diagonal
+				sx, sy = y, x
+			case 6: // needs rotating 90° clockwise
+				sx, sy = y, height-1-x
+			case 7: // mirrored along the top-right to bottom-left diagonal
+				sx, sy = width-1-y, height-1-x
+			case 8: // needs rotating 90° counterclockwise
+				sx, sy = width-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:sy*src.Stride+sx*4+4])
+		}
+	}
+	return dst
+}
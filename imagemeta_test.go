@@ -0,0 +1,303 @@
+package notebrew
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+// exifTIFF returns the EXIF data (a TIFF structure) of an image with the
+// given orientation.
+func exifTIFF(order binary.ByteOrder, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	b := make([]byte, 2+4+2+12+4)
+	order.PutUint16(b[0:2], 42)
+	order.PutUint32(b[2:6], 8) // offset of the first IFD
+	order.PutUint16(b[6:8], 1) // number of entries
+	order.PutUint16(b[8:10], 0x0112)
+	order.PutUint16(b[10:12], 3) // SHORT
+	order.PutUint32(b[12:16], 1) // count
+	order.PutUint16(b[16:18], orientation)
+	buf.Write(b)
+	return buf.Bytes()
+}
+
+// jpegSegment returns a JPEG marker segment with the given payload.
+func jpegSegment(marker byte, payload string) string {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(payload)+2))
+	return "\xFF" + string([]byte{marker}) + string(length) + payload
+}
+
+// pngChunk returns a PNG chunk with the given type and data. If badCRC is
+// true, the CRC of the chunk is corrupted.
+func pngChunk(chunkType string, data string, badCRC bool) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	crc := crc32.ChecksumIEEE([]byte(chunkType + data))
+	if badCRC {
+		crc++
+	}
+	c := make([]byte, 4)
+	binary.BigEndian.PutUint32(c, crc)
+	return string(b) + chunkType + data + string(c)
+}
+
+func TestExifOrientation(t *testing.T) {
+	type TestTable struct {
+		description     string
+		tiff            []byte
+		wantOrientation int
+	}
+
+	tests := []TestTable{{
+		description:     "little endian",
+		tiff:            exifTIFF(binary.LittleEndian, 6),
+		wantOrientation: 6,
+	}, {
+		description:     "big endian",
+		tiff:            exifTIFF(binary.BigEndian, 8),
+		wantOrientation: 8,
+	}, {
+		description:     "out of range",
+		tiff:            exifTIFF(binary.LittleEndian, 9),
+		wantOrientation: 0,
+	}, {
+		description:     "bad byte order",
+		tiff:            append([]byte("XX"), exifTIFF(binary.LittleEndian, 6)[2:]...),
+		wantOrientation: 0,
+	}, {
+		description:     "truncated",
+		tiff:            exifTIFF(binary.LittleEndian, 6)[:14],
+		wantOrientation: 0,
+	}, {
+		description:     "empty",
+		tiff:            nil,
+		wantOrientation: 0,
+	}}
+
+	for _, tt := range tests {
+		if gotOrientation := exifOrientation(tt.tiff); gotOrientation != tt.wantOrientation {
+			t.Errorf("%s: got %d, want %d", tt.description, gotOrientation, tt.wantOrientation)
+		}
+	}
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	exif := "Exif\x00\x00" + string(exifTIFF(binary.BigEndian, 3))
+	app0 := jpegSegment(0xE0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	icc := jpegSegment(0xE2, "ICC_PROFILE\x00\x01\x01profile")
+	adobe := jpegSegment(0xEE, "Adobe\x00\x64\x00\x00\x00\x00\x01")
+	dqt := jpegSegment(0xDB, "\x00quantization")
+	scan := "\xFF\xDA\x00\x08scan\x00\xFF\x00data\xFF\xD9"
+	data := "\xFF\xD8" +
+		app0 +
+		jpegSegment(0xE1, exif) +
+		jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>") +
+		icc +
+		jpegSegment(0xE2, "FPXR\x00flashpix") +
+		jpegSegment(0xED, "Photoshop 3.0\x00iptc") +
+		adobe +
+		jpegSegment(0xFE, "a comment") +
+		"\xFF\xFF" + dqt + // fill bytes before a marker
+		scan
+
+	stripped, orientation, err := stripJPEGMetadata([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orientation != 3 {
+		t.Errorf("got orientation %d, want 3", orientation)
+	}
+	wantStripped := "\xFF\xD8" + app0 + icc + adobe + dqt + scan
+	if string(stripped) != wantStripped {
+		t.Errorf("\ngot  %q\nwant %q", stripped, wantStripped)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"not a jpeg",
+		"\xFF\xD8",
+		"\xFF\xD8\xFF\xE1\x00\x40short",
+		"\xFF\xD8\xFF\xE1\x00\x01xx",
+		"\xFF\xD8\x00\x00\x00\x00",
+	} {
+		_, _, err := stripJPEGMetadata([]byte(invalid))
+		if !errors.Is(err, errInvalidJPEG) {
+			t.Errorf("%q: got error %v, want %v", invalid, err, errInvalidJPEG)
+		}
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	ihdr := pngChunk("IHDR", "\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00", false)
+	idat := pngChunk("IDAT", "compressed", false)
+	iend := pngChunk("IEND", "", false)
+	exif := string(exifTIFF(binary.LittleEndian, 5))
+
+	type TestTable struct {
+		description     string
+		data            string
+		wantStripped    string
+		wantOrientation int
+	}
+
+	tests := []TestTable{{
+		description: "metadata chunks removed",
+		data: pngSignature + ihdr +
+			pngChunk("tEXt", "Comment\x00hello", false) +
+			pngChunk("eXIf", exif, false) +
+			pngChunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x/>", false) +
+			pngChunk("zTXt", "Author\x00\x00compressed", false) +
+			pngChunk("tIME", "\x07\xea\x0a\x11\x00\x00\x00", false) +
+			idat + iend,
+		wantStripped:    pngSignature + ihdr + idat + iend,
+		wantOrientation: 5,
+	}, {
+		description: "corrupted eXIf chunk ignored",
+		data: pngSignature + ihdr +
+			pngChunk("eXIf", exif, true) +
+			idat + iend,
+		wantStripped:    pngSignature + ihdr + idat + iend,
+		wantOrientation: 0,
+	}, {
+		description:     "trailing data after IEND dropped",
+		data:            pngSignature + ihdr + idat + iend + "garbage",
+		wantStripped:    pngSignature + ihdr + idat + iend,
+		wantOrientation: 0,
+	}}
+
+	for _, tt := range tests {
+		stripped, orientation, err := stripPNGMetadata([]byte(tt.data))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.description, err)
+		}
+		if string(stripped) != tt.wantStripped {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.description, stripped, tt.wantStripped)
+		}
+		if orientation != tt.wantOrientation {
+			t.Errorf("%s: got orientation %d, want %d", tt.description, orientation, tt.wantOrientation)
+		}
+	}
+
+	for _, invalid := range []string{
+		"",
+		"not a png",
+		pngSignature + "\x00\x00",
+		pngSignature + "\x00\x00\x00\x40IDATshort",
+	} {
+		_, _, err := stripPNGMetadata([]byte(invalid))
+		if !errors.Is(err, errInvalidPNG) {
+			t.Errorf("%q: got error %v, want %v", invalid, err, errInvalidPNG)
+		}
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// The source image is 3x2 and its pixels are labelled A to F:
+	//
+	//	A B C
+	//	D E F
+	const A, B, C, D, E, F = 10, 20, 30, 40, 50, 60
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	copy(src.Pix, []uint8{A, B, C, D, E, F})
+
+	type TestTable struct {
+		orientation int
+		wantWidth   int
+		wantPixels  []uint8
+	}
+
+	tests := []TestTable{
+		{orientation: 1, wantWidth: 3, wantPixels: []uint8{A, B, C, D, E, F}},
+		{orientation: 2, wantWidth: 3, wantPixels: []uint8{C, B, A, F, E, D}},
+		{orientation: 3, wantWidth: 3, wantPixels: []uint8{F, E, D, C, B, A}},
+		{orientation: 4, wantWidth: 3, wantPixels: []uint8{D, E, F, A, B, C}},
+		{orientation: 5, wantWidth: 2, wantPixels: []uint8{A, D, B, E, C, F}},
+		{orientation: 6, wantWidth: 2, wantPixels: []uint8{D, A, E, B, F, C}},
+		{orientation: 7, wantWidth: 2, wantPixels: []uint8{F, C, E, B, D, A}},
+		{orientation: 8, wantWidth: 2, wantPixels: []uint8{C, F, B, E, A, D}},
+	}
+
+	for _, tt := range tests {
+		dst := orientImage(src, tt.orientation)
+		if dst.Rect.Dx() != tt.wantWidth || dst.Rect.Dx()*dst.Rect.Dy() != 6 {
+			t.Errorf("orientation %d: got %dx%d, want width %d", tt.orientation, dst.Rect.Dx(), dst.Rect.Dy(), tt.wantWidth)
+			continue
+		}
+		var gotPixels []uint8
+		for y := 0; y < dst.Rect.Dy(); y++ {
+			for x := 0; x < dst.Rect.Dx(); x++ {
+				gotPixels = append(gotPixels, dst.RGBAAt(x, y).R)
+			}
+		}
+		if !reflect.DeepEqual(gotPixels, tt.wantPixels) {
+			t.Errorf("orientation %d: got %v, want %v", tt.orientation, gotPixels, tt.wantPixels)
+		}
+	}
+}
+
+func TestStripImageMetadata(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 30, 20))
+	for i := range src.Pix {
+		src.Pix[i] = 255
+	}
+
+	// A JPEG with an EXIF orientation is rotated, so that it comes back
+	// with its width and height swapped.
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte("\xFF\xD8"+jpegSegment(0xE1, "Exif\x00\x00"+string(exifTIFF(binary.LittleEndian, 6)))), buf.Bytes()[2:]...)
+	stripped, err := stripImageMetadata("image/jpeg", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stripped, []byte("Exif")) {
+		t.Errorf("EXIF data not removed")
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 20 || config.Height != 30 {
+		t.Errorf("got %dx%d, want 20x30", config.Width, config.Height)
+	}
+
+	// A PNG without an orientation isn't re-encoded.
+	buf.Reset()
+	err = png.Encode(&buf, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped, err = stripImageMetadata("image/png", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, buf.Bytes()) {
+		t.Errorf("PNG without metadata changed")
+	}
+
+	// Other content types are returned unchanged.
+	gif := []byte("GIF89a")
+	stripped, err = stripImageMetadata("image/gif", gif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, gif) {
+		t.Errorf("GIF changed")
+	}
+}
@@ -0,0 +1,201 @@
+package notebrew
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// RunBackgroundJobs runs the periodic maintenance jobs of the app until ctx is
+// canceled.
+func (app *App) RunBackgroundJobs(ctx context.Context) {
+	purgeTicker := time.NewTicker(time.Hour)
+	defer purgeTicker.Stop()
+	// Garbage collection scans every note, so it runs less often.
+	gcTicker := time.NewTicker(24 * time.Hour)
+	defer gcTicker.Stop()
+	// Scheduled posts are published as close to their publish time as
+	// possible, see publishScheduledPosts.
+	publishTimer := time.NewTimer(app.publishScheduledPosts(ctx))
+	defer publishTimer.Stop()
+	app.purgeTrash(ctx)
+	app.collectGarbage(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-purgeTicker.C:
+			app.purgeTrash(ctx)
+		case <-gcTicker.C:
+			app.collectGarbage(ctx)
+		case <-publishTimer.C:
+			publishTimer.Reset(app.publishScheduledPosts(ctx))
+		}
+	}
+}
+
+// publishScheduledPosts publishes the scheduled posts that are due and returns
+// how long to wait before doing it again: until the next scheduled post is
+// due, but no longer than a minute so that posts scheduled in the meantime are
+// picked up.
+func (app *App) publishScheduledPosts(ctx context.Context) time.Duration {
+	published, next, err := app.PublishScheduledPosts(ctx)
+	if err != nil {
+		log.Println(err)
+	} else if published > 0 {
+		log.Printf("published %d scheduled posts", published)
+	}
+	wait := time.Minute
+	if !next.IsZero() && time.Until(next) < wait {
+		wait = time.Until(next)
+		if wait < 0 {
+			wait = 0
+		}
+	}
+	return wait
+}
+
+func (app *App) purgeTrash(ctx context.Context) {
+	purged, err := app.PurgeTrash(ctx)
+	if err != nil {
+		log.Println(err)
+	} else if purged > 0 {
+		log.Printf("purged %d notes from the trash", purged)
+	}
+}
+
+func (app *App) collectGarbage(ctx context.Context) {
+	report, err := app.CollectGarbage(ctx, app.ImageGracePeriod, false)
+	if err != nil {
+		log.Println(err)
+	} else if len(report.Images) > 0 || len(report.Files) > 0 {
+		log.Printf("garbage collected %d images and %d files", len(report.Images), len(report.Files))
+	}
+}
+
+// PurgeTrash permanently deletes the notes that have been in the trash for
+// longer than app.TrashRetention and returns the number of notes deleted.
+func (app *App) PurgeTrash(ctx context.Context) (int64, error) {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	NOTE := sq.New[NOTE]("")
+	expired := NOTE.DELETED_AT.LtTime(time.Now().UTC().Add(-app.TrashRetention))
+	// Lock the expired notes so that they can't be restored between adding
+	// up their sizes and deleting them.
+	query := sq.
+		From(NOTE).
+		Where(expired).
+		SetDialect(app.Dialect)
+	if app.Dialect != sq.DialectSQLite {
+		query.LockClause = "FOR UPDATE"
+	}
+	notes, err := sq.FetchAllContext(ctx, tx, query, func(row *sq.Row) (note struct {
+		UserID ulid.ULID
+		Size   int64
+	}) {
+		row.UUIDField(&note.UserID, NOTE.USER_ID)
+		note.Size = row.Int64Field(octetLength(app.Dialect, NOTE.BODY))
+		return note
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(notes) == 0 {
+		return 0, nil
+	}
+	// The revisions of the notes are deleted along with them by the foreign
+	// key of NOTE_REVISION.
+	NOTE_REVISION := sq.New[NOTE_REVISION]("")
+	revisions, err := sq.FetchAllContext(ctx, tx, sq.
+		From(NOTE_REVISION).
+		Join(NOTE,
+			NOTE.USER_ID.Eq(NOTE_REVISION.USER_ID),
+			NOTE.NOTE_NUMBER.Eq(NOTE_REVISION.NOTE_NUMBER),
+		).
+		Where(expired).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (revision struct {
+			UserID ulid.ULID
+			Size   int64
+		}) {
+			row.UUIDField(&revision.UserID, NOTE_REVISION.USER_ID)
+			revision.Size = row.Int64Field(octetLength(app.Dialect, NOTE_REVISION.BODY))
+			return revision
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	freed := make(map[ulid.ULID]Quota)
+	for _, note := range notes {
+		usage := freed[note.UserID]
+		usage.Notes--
+		usage.NoteBytes -= note.Size
+		freed[note.UserID] = usage
+	}
+	for _, revision := range revisions {
+		usage := freed[revision.UserID]
+		usage.NoteBytes -= revision.Size
+		freed[revision.UserID] = usage
+	}
+	for userID, delta := range freed {
+		err = app.updateUsage(ctx, tx, userID, delta)
+		if err != nil {
+			return 0, err
+		}
+	}
+	result, err := sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(NOTE).
+		Where(expired).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected, nil
+}
+
+// PublishScheduledPosts marks the scheduled posts whose publish time has
+// passed as published. It returns the number of posts published and the
+// publish time of the next scheduled post, or the zero time if there are none.
+func (app *App) PublishScheduledPosts(ctx context.Context) (published int64, next time.Time, err error) {
+	POST := sq.New[POST]("")
+	result, err := sq.ExecContext(ctx, app.DB, sq.
+		Update(POST).
+		Set(POST.STATUS.SetString(postPublished)).
+		Where(
+			POST.STATUS.EqString(postScheduled),
+			POST.PUBLISH_AT.LeTime(time.Now().UTC()),
+		).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	next, err = sq.FetchOneContext(ctx, app.DB, sq.
+		From(POST).
+		Where(POST.STATUS.EqString(postScheduled)).
+		OrderBy(POST.PUBLISH_AT).
+		Limit(1).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) time.Time {
+			return row.TimeField(POST.PUBLISH_AT)
+		},
+	)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return result.RowsAffected, time.Time{}, err
+	}
+	return result.RowsAffected, next, nil
+}
@@ -0,0 +1,4 @@
+-- Posts written before they could be scheduled were published when they were
+-- created, which is the timestamp in the first 6 bytes of their ULID.
+UPDATE post SET publish_at = TIMESTAMPADD(MICROSECOND, CONV(HEX(SUBSTRING(post_id, 1, 6)), 16, 10) * 1000, '1970-01-01 00:00:00')
+WHERE status = 'published' AND publish_at IS NULL;
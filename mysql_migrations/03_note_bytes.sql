@@ -0,0 +1,5 @@
+-- The revisions of notes count towards the storage used by each user as
+-- well.
+UPDATE users SET note_bytes =
+    (SELECT COALESCE(SUM(OCTET_LENGTH(body)), 0) FROM note WHERE note.user_id = users.user_id)
+    + (SELECT COALESCE(SUM(OCTET_LENGTH(body)), 0) FROM note_revision WHERE note_revision.user_id = users.user_id);
@@ -0,0 +1,3 @@
+-- The bodies of posts count towards the storage used by each user as well.
+UPDATE users SET note_bytes = note_bytes
+    + (SELECT COALESCE(SUM(OCTET_LENGTH(post.body)), 0) FROM post JOIN blog ON blog.blog_id = post.blog_id WHERE blog.user_id = users.user_id);
@@ -15,12 +15,19 @@ CREATE TABLE IF NOT EXISTS note_fts (
     ,FULLTEXT INDEX note_fts_body_idx (body)
 );
 
+-- Repopulate the index from the existing notes, since it was just dropped.
+-- Notes in the trash stay indexed (so that restoring a note does not have to
+-- touch the index), search queries filter them out instead.
+INSERT INTO note_fts (user_id, note_number, body) SELECT user_id, note_number, body FROM note;
+
 CREATE TRIGGER note_after_insert_trigger AFTER INSERT ON note FOR EACH ROW BEGIN
     INSERT INTO note_fts (user_id, note_number, body) VALUES (NEW.user_id, NEW.note_number, NEW.body);
 END;
 
+-- Only changes to the body need to be reindexed, moving a note in or out of
+-- the trash (which updates deleted_at) does not.
 CREATE TRIGGER note_after_update_trigger AFTER UPDATE ON note FOR EACH ROW BEGIN
-    IF OLD.body <> NEW.body THEN
+    IF NOT (OLD.body <=> NEW.body) THEN
         UPDATE note_fts
         SET body = NEW.body
         WHERE user_id = NEW.user_id AND note_number = NEW.note_number;
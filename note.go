@@ -2,30 +2,57 @@ package notebrew
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
-	"io/fs"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
 )
 
 func (app *App) Note(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" && r.Method != "POST" {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "PUT" {
 		app.Error(w, r, http.StatusMethodNotAllowed, nil)
 		return
 	}
 
 	segments := strings.Split(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/")
-	if segments[0] != "note" || len(segments) > 2 {
+	if segments[0] != "note" || len(segments) > 3 {
 		app.Error(w, r, http.StatusNotFound, nil)
 		return
 	}
+	// PUT is only for replacing the body or the tags of a note number.
+	if r.Method == "PUT" && len(segments) != 2 && !(len(segments) == 3 && segments[2] == "tags") {
+		app.Error(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	if len(segments) == 3 {
+		switch segments[2] {
+		case "history", "tags":
+		case "trash", "restore", "delete", "publish":
+			if r.Method != "POST" {
+				app.Error(w, r, http.StatusMethodNotAllowed, nil)
+				return
+			}
+		default:
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+	}
 
 	currentUserID, loggedIn := app.CurrentUserID(r)
 	if !loggedIn {
@@ -35,12 +62,23 @@ func (app *App) Note(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Get or replace the tags of a note.
+	if len(segments) == 3 && segments[2] == "tags" {
+		noteNumber, err := strconv.Atoi(segments[1])
+		if err != nil {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.noteTagsAPI(w, r, currentUserID, noteNumber)
+		return
+	}
+
 	if r.Method == "GET" {
 		err := r.ParseForm()
 		if err != nil {
 			log.Println(err)
 		}
-		if len(segments) == 2 {
+		if len(segments) >= 2 {
 			noteNumber, err := strconv.Atoi(segments[1])
 			if err != nil {
 				app.Error(w, r, http.StatusNotFound, nil)
@@ -52,6 +90,7 @@ func (app *App) Note(w http.ResponseWriter, r *http.Request) {
 				Where(
 					NOTE.USER_ID.EqUUID(currentUserID),
 					NOTE.NOTE_NUMBER.EqInt(noteNumber),
+					NOTE.DELETED_AT.IsNull(),
 				).
 				SetDialect(app.Dialect),
 				func(row *sq.Row) string {
@@ -59,30 +98,35 @@ func (app *App) Note(w http.ResponseWriter, r *http.Request) {
 				},
 			)
 			if err != nil {
-				if errors.Is(err, fs.ErrNotExist) {
+				if errors.Is(err, sql.ErrNoRows) {
 					app.Error(w, r, http.StatusNotFound, nil)
 					return
 				}
 				app.Error(w, r, http.StatusInternalServerError, err)
 				return
 			}
+			if len(segments) == 3 {
+				app.noteHistory(w, r, currentUserID, noteNumber)
+				return
+			}
+			etag := noteETag(body)
 			if r.Form.Has("edit") {
-				// err := server.Render(w, "html/edit_note.html", nil)
-				tmpl, err := template.ParseFiles("html/edit_note.html")
+				tags, err := app.noteTagNames(r.Context(), app.DB, currentUserID, noteNumber)
 				if err != nil {
 					app.Error(w, r, http.StatusInternalServerError, err)
 					return
 				}
-				var buf bytes.Buffer
-				err = tmpl.Execute(&buf, nil)
-				if err != nil {
-					app.Error(w, r, http.StatusInternalServerError, err)
-					return
-				}
-				_, err = buf.WriteTo(w)
-				if err != nil {
-					log.Println(err)
-				}
+				app.noteEditor(w, r, http.StatusOK, currentUserID, noteEditorData{
+					NoteNumber: noteNumber,
+					Body:       body,
+					ETag:       etag,
+					Tags:       strings.Join(tags, ", "),
+				})
+				return
+			}
+			w.Header().Set("ETag", etag)
+			if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+				w.WriteHeader(http.StatusNotModified)
 				return
 			}
 			_, err = io.WriteString(w, body)
@@ -91,11 +135,15 @@ func (app *App) Note(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		filename := "html/notes.html"
-		if r.Form.Has("new") {
-			filename = "html/new_note.html"
+		if r.Form.Has("trash") {
+			app.noteTrash(w, r, currentUserID)
+			return
+		}
+		if !r.Form.Has("new") {
+			app.noteList(w, r, currentUserID)
+			return
 		}
-		tmpl, err := template.ParseFiles(filename)
+		tmpl, err := template.ParseFiles("html/new_note.html")
 		if err != nil {
 			app.Error(w, r, http.StatusInternalServerError, err)
 			return
@@ -113,33 +161,600 @@ func (app *App) Note(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Publish the note as a post, or update the post it was published as.
+	if len(segments) == 3 && segments[2] == "publish" {
+		noteNumber, err := strconv.Atoi(segments[1])
+		if err != nil {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		err = r.ParseForm()
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, err)
+			return
+		}
+		blogID, err := ulid.Parse(r.PostForm.Get("blog_id"))
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, "invalid blog")
+			return
+		}
+		postID, err := app.publishNote(r.Context(), currentUserID, noteNumber, blogID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				app.Error(w, r, http.StatusNotFound, nil)
+				return
+			}
+			if errors.Is(err, errNoteInTrash) {
+				app.Error(w, r, http.StatusConflict, err)
+				return
+			}
+			if errors.Is(err, errEmptyNote) {
+				app.Error(w, r, http.StatusBadRequest, err)
+				return
+			}
+			if isQuotaError(err) {
+				app.Error(w, r, http.StatusInsufficientStorage, err)
+				return
+			}
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, r, "/post/"+strings.ToLower(postID.String())+"/", http.StatusFound)
+		return
+	}
+
+	// Move a note to the trash, restore it from the trash or delete it
+	// permanently.
+	if len(segments) == 3 && segments[2] != "history" {
+		noteNumber, err := strconv.Atoi(segments[1])
+		if err != nil {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		NOTE := sq.New[NOTE]("")
+		var query sq.Query
+		var redirectURL string
+		switch segments[2] {
+		case "trash":
+			query = sq.
+				Update(NOTE).
+				Set(NOTE.DELETED_AT.SetTime(time.Now().UTC())).
+				Where(
+					NOTE.USER_ID.EqUUID(currentUserID),
+					NOTE.NOTE_NUMBER.EqInt(noteNumber),
+					NOTE.DELETED_AT.IsNull(),
+				).
+				SetDialect(app.Dialect)
+			redirectURL = "/note/"
+		case "restore":
+			query = sq.
+				Update(NOTE).
+				Set(NOTE.DELETED_AT.Set(nil)).
+				Where(
+					NOTE.USER_ID.EqUUID(currentUserID),
+					NOTE.NOTE_NUMBER.EqInt(noteNumber),
+					NOTE.DELETED_AT.IsNotNull(),
+				).
+				SetDialect(app.Dialect)
+			redirectURL = "/note/" + strconv.Itoa(noteNumber) + "/"
+		case "delete":
+			err = app.deleteNote(r.Context(), currentUserID, noteNumber)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					app.Error(w, r, http.StatusNotFound, nil)
+					return
+				}
+				app.Error(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			http.Redirect(w, r, "/note/?trash", http.StatusFound)
+			return
+		}
+		result, err := sq.ExecContext(r.Context(), app.DB, query)
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if result.RowsAffected == 0 {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+		return
+	}
+
+	// Restore a revision from the note's history.
+	if len(segments) == 3 {
+		noteNumber, err := strconv.Atoi(segments[1])
+		if err != nil {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		err = r.ParseForm()
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, err)
+			return
+		}
+		revisionID, err := ulid.Parse(r.PostForm.Get("restore"))
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, "invalid revision")
+			return
+		}
+		err = app.restoreNoteRevision(r.Context(), currentUserID, noteNumber, revisionID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				app.Error(w, r, http.StatusNotFound, nil)
+				return
+			}
+			if errors.Is(err, errNoteInTrash) {
+				app.Error(w, r, http.StatusConflict, err)
+				return
+			}
+			if isQuotaError(err) {
+				app.Error(w, r, http.StatusInsufficientStorage, err)
+				return
+			}
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, r, "/note/"+strconv.Itoa(noteNumber)+"/", http.StatusFound)
+		return
+	}
+
+	body, err := readNoteBody(w, r)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			app.Error(w, r, http.StatusRequestEntityTooLarge, errNoteTooLarge)
+			return
+		}
+		app.Error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if len(body) > maxNoteSize {
+		app.Error(w, r, http.StatusRequestEntityTooLarge, errNoteTooLarge)
+		return
+	}
+	// HTML forms can set the tags of the note along with its body.
+	tags, err := readTagsField(r)
+	if err != nil {
+		app.Error(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// Create a new note.
 	if len(segments) < 2 {
-		app.Error(w, r, http.StatusNotFound, nil)
+		noteNumber, err := app.createNote(r.Context(), currentUserID, body, tags)
+		if err != nil {
+			if isQuotaError(err) {
+				app.Error(w, r, http.StatusInsufficientStorage, err)
+				return
+			}
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, r, "/note/"+strconv.Itoa(noteNumber)+"/", http.StatusFound)
 		return
 	}
+
+	// Create or update the note at the given note number. If the client sent
+	// an If-Match header (or the if_match form field, for HTML forms), the
+	// note is only updated if it has not changed since the client fetched it.
 	noteNumber, err := strconv.Atoi(segments[1])
-	if err != nil {
+	if err != nil || noteNumber <= 0 {
 		app.Error(w, r, http.StatusNotFound, nil)
 		return
 	}
-	var b strings.Builder
-	_, err = io.Copy(&b, r.Body)
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		ifMatch = r.PostForm.Get("if_match")
+	}
+	etag, err := app.updateNote(r.Context(), currentUserID, noteNumber, body, tags, ifMatch)
 	if err != nil {
-		app.Error(w, r, http.StatusNotFound, nil)
+		var conflictErr *noteConflictError
+		if errors.As(err, &conflictErr) {
+			// Send back the current copy of the note so that the client
+			// can merge it with its own changes.
+			if r.PostForm.Has("body") {
+				app.noteEditor(w, r, http.StatusPreconditionFailed, currentUserID, noteEditorData{
+					NoteNumber: noteNumber,
+					Body:       body,
+					ETag:       conflictErr.ETag,
+					Tags:       r.PostForm.Get("tags"),
+					Conflict:   true,
+					ServerBody: conflictErr.Body,
+				})
+				return
+			}
+			if conflictErr.ETag != "" {
+				w.Header().Set("ETag", conflictErr.ETag)
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, err = io.WriteString(w, conflictErr.Body)
+			if err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		if errors.Is(err, errNoteInTrash) {
+			app.Error(w, r, http.StatusConflict, err)
+			return
+		}
+		if isQuotaError(err) {
+			app.Error(w, r, http.StatusInsufficientStorage, err)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if r.Method == "PUT" {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	body := b.String()
+	http.Redirect(w, r, "/note/"+strconv.Itoa(noteNumber)+"/", http.StatusFound)
+}
+
+type noteEditorData struct {
+	NoteNumber int
+	Body       string
+	ETag       string
+	// Tags are the tags of the note separated by commas.
+	Tags string
+	// Conflict is true if the note was changed by someone else since it was
+	// opened in the editor, in which case ServerBody holds the current body.
+	Conflict   bool
+	ServerBody string
+	// Publications are the user's blogs that the note can be published to.
+	Publications []notePublication
+}
+
+// noteEditor renders the form for editing a note.
+func (app *App) noteEditor(w http.ResponseWriter, r *http.Request, code int, userID ulid.ULID, templateData noteEditorData) {
+	var err error
+	templateData.Publications, err = app.notePublications(r.Context(), userID, templateData.NoteNumber)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// err := server.Render(w, "html/edit_note.html", nil)
+	tmpl, err := template.ParseFiles("html/edit_note.html")
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, templateData)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(code)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// noteETag returns the entity tag of a note body.
+func noteETag(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether the value of an If-Match or If-None-Match
+// header matches etag. The header may contain a comma-separated list of
+// entity tags or "*", which matches any etag. If-None-Match uses the weak
+// comparison, which ignores the W/ prefix of weak entity tags, while If-Match
+// uses the strong comparison, which no weak entity tag matches (RFC 9110
+// section 13.1.1).
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "*" {
+			return true
+		}
+		if strings.HasPrefix(value, "W/") {
+			if !weak {
+				continue
+			}
+			value = strings.TrimPrefix(value, "W/")
+		}
+		if value == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// noteConflictError is returned when a note is updated with an If-Match
+// precondition that does not match the note's current ETag.
+type noteConflictError struct {
+	// Body is the current body of the note.
+	Body string
+	// ETag is the current ETag of the note, or empty if the note does not
+	// exist.
+	ETag string
+}
+
+func (e *noteConflictError) Error() string {
+	return "note has been modified"
+}
+
+// createNote creates a note with the next available note number and returns
+// that note number.
+func (app *App) createNote(ctx context.Context, userID ulid.ULID, body string, tags []string) (int, error) {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	noteNumber, err := nextNoteNumber(ctx, tx, app.Dialect, userID)
+	if err != nil {
+		return 0, err
+	}
+	err = app.saveNote(ctx, tx, userID, noteNumber, body)
+	if err != nil {
+		return 0, err
+	}
+	if len(tags) > 0 {
+		err = app.setNoteTags(ctx, tx, userID, noteNumber, tags)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return noteNumber, nil
+}
+
+// updateNote creates or updates the note at the given note number and
+// returns the new ETag of the note. The tags of the note are replaced unless
+// tags is nil. If ifMatch is not empty, it is checked against the current
+// ETag of the note and a *noteConflictError is returned if it does not match.
+func (app *App) updateNote(ctx context.Context, userID ulid.ULID, noteNumber int, body string, tags []string, ifMatch string) (etag string, err error) {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if ifMatch != "" {
+		// Lock the note's row so that nobody else can update it between
+		// checking the precondition and saving the note (SQLite
+		// transactions already lock the whole database).
+		NOTE := sq.New[NOTE]("")
+		query := sq.
+			From(NOTE).
+			Where(
+				NOTE.USER_ID.EqUUID(userID),
+				NOTE.NOTE_NUMBER.EqInt(noteNumber),
+			).
+			SetDialect(app.Dialect)
+		if app.Dialect != sq.DialectSQLite {
+			query.LockClause = "FOR UPDATE"
+		}
+		currentBody, err := sq.FetchOneContext(ctx, tx, query, func(row *sq.Row) string {
+			return row.StringField(NOTE.BODY)
+		})
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return "", err
+			}
+			// A note that does not exist cannot match any ETag.
+			return "", &noteConflictError{}
+		}
+		currentETag := noteETag(currentBody)
+		if !etagMatches(ifMatch, currentETag, false) {
+			return "", &noteConflictError{Body: currentBody, ETag: currentETag}
+		}
+	}
+	err = app.saveNote(ctx, tx, userID, noteNumber, body)
+	if err != nil {
+		return "", err
+	}
+	if tags != nil {
+		err = app.setNoteTags(ctx, tx, userID, noteNumber, tags)
+		if err != nil {
+			return "", err
+		}
+	}
+	// Make sure notes created with POST /note/ never reuse this note number.
+	USERS := sq.New[USERS]("")
+	_, err = sq.ExecContext(ctx, tx, sq.
+		Update(USERS).
+		Set(USERS.LAST_NOTE_NUMBER.SetInt(noteNumber)).
+		Where(
+			USERS.USER_ID.EqUUID(userID),
+			USERS.LAST_NOTE_NUMBER.LtInt(noteNumber),
+		).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return "", err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+	return noteETag(body), nil
+}
+
+// restoreNoteRevision sets the body of a note back to the body it had at the
+// given revision. It returns sql.ErrNoRows if the revision does not exist.
+func (app *App) restoreNoteRevision(ctx context.Context, userID ulid.ULID, noteNumber int, revisionID ulid.ULID) error {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	NOTE_REVISION := sq.New[NOTE_REVISION]("")
+	body, err := sq.FetchOneContext(ctx, tx, sq.
+		From(NOTE_REVISION).
+		Where(
+			NOTE_REVISION.REVISION_ID.EqUUID(revisionID),
+			NOTE_REVISION.USER_ID.EqUUID(userID),
+			NOTE_REVISION.NOTE_NUMBER.EqInt(noteNumber),
+		).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) string {
+			return row.StringField(NOTE_REVISION.BODY)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	err = app.saveNote(ctx, tx, userID, noteNumber, body)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteNote permanently deletes a note that is in the trash. It returns
+// sql.ErrNoRows if the user has no such note in the trash.
+func (app *App) deleteNote(ctx context.Context, userID ulid.ULID, noteNumber int) error {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 	NOTE := sq.New[NOTE]("")
+	// Only notes that are already in the trash can be deleted permanently.
+	condition := sq.And(
+		NOTE.USER_ID.EqUUID(userID),
+		NOTE.NOTE_NUMBER.EqInt(noteNumber),
+		NOTE.DELETED_AT.IsNotNull(),
+	)
+	body, err := sq.FetchOneContext(ctx, tx, sq.
+		From(NOTE).
+		Where(condition).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) string {
+			return row.StringField(NOTE.BODY)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	// The note's revisions are deleted along with it by the foreign key of
+	// NOTE_REVISION, so they are refunded too.
+	NOTE_REVISION := sq.New[NOTE_REVISION]("")
+	revisionBytes, err := app.noteRevisionBytes(ctx, tx, sq.And(
+		NOTE_REVISION.USER_ID.EqUUID(userID),
+		NOTE_REVISION.NOTE_NUMBER.EqInt(noteNumber),
+	))
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(NOTE).
+		Where(condition).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	err = app.updateUsage(ctx, tx, userID, Quota{Notes: -1, NoteBytes: -int64(len(body)) - revisionBytes})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// errNoteInTrash is returned when trying to save a note that is in the
+// trash. The note has to be restored before it can be edited.
+var errNoteInTrash = errors.New("note is in the trash")
+
+// maxNoteRevisions is the number of revisions kept in the history of a note.
+// Older revisions are pruned as new ones are recorded.
+const maxNoteRevisions = 50
+
+// saveNote creates or updates a note inside a transaction. Unless the body is
+// unchanged, the new body is also recorded in NOTE_REVISION so that it can be
+// restored later, and the revisions past the last maxNoteRevisions are
+// pruned. Revisions count towards the user's NoteBytes as much as the note
+// itself.
+func (app *App) saveNote(ctx context.Context, tx *sql.Tx, userID ulid.ULID, noteNumber int, body string) error {
+	dialect := app.Dialect
+	NOTE := sq.New[NOTE]("")
+	oldNote, err := sq.FetchOneContext(ctx, tx, sq.
+		From(NOTE).
+		Where(
+			NOTE.USER_ID.EqUUID(userID),
+			NOTE.NOTE_NUMBER.EqInt(noteNumber),
+		).
+		SetDialect(dialect),
+		func(row *sq.Row) (result struct {
+			Body    string
+			Trashed bool
+		}) {
+			result.Body = row.StringField(NOTE.BODY)
+			result.Trashed = row.NullTimeField(NOTE.DELETED_AT).Valid
+			return result
+		},
+	)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	exists := err == nil
+	if exists && oldNote.Trashed {
+		return errNoteInTrash
+	}
+	if exists && oldNote.Body == body {
+		return nil
+	}
+	// Charge the user for the new note (or for the change in its size) and
+	// for the revision recording it.
+	delta := Quota{Notes: 1, NoteBytes: 2 * int64(len(body))}
+	if exists {
+		delta = Quota{NoteBytes: 2*int64(len(body)) - int64(len(oldNote.Body))}
+	}
+	NOTE_REVISION := sq.New[NOTE_REVISION]("")
+	// Notes written before NOTE_REVISION existed have no history yet, so
+	// preserve their current body before overwriting it.
+	if exists {
+		hasRevisions, err := sq.FetchExistsContext(ctx, tx, sq.
+			SelectOne().
+			From(NOTE_REVISION).
+			Where(
+				NOTE_REVISION.USER_ID.EqUUID(userID),
+				NOTE_REVISION.NOTE_NUMBER.EqInt(noteNumber),
+			).
+			SetDialect(dialect),
+		)
+		if err != nil {
+			return err
+		}
+		if !hasRevisions {
+			_, err = sq.ExecContext(ctx, tx, sq.
+				InsertInto(NOTE_REVISION).
+				ColumnValues(func(col *sq.Column) {
+					col.SetUUID(NOTE_REVISION.REVISION_ID, ulid.Make())
+					col.SetUUID(NOTE_REVISION.USER_ID, userID)
+					col.SetInt(NOTE_REVISION.NOTE_NUMBER, noteNumber)
+					col.SetString(NOTE_REVISION.BODY, oldNote.Body)
+				}).
+				SetDialect(dialect),
+			)
+			if err != nil {
+				return err
+			}
+			delta.NoteBytes += int64(len(oldNote.Body))
+		}
+	}
 	insertQuery := sq.InsertQuery{
-		Dialect:     app.Dialect,
+		Dialect:     dialect,
 		InsertTable: NOTE,
 		ColumnMapper: func(col *sq.Column) {
-			col.SetUUID(NOTE.USER_ID, currentUserID)
+			col.SetUUID(NOTE.USER_ID, userID)
 			col.SetInt(NOTE.NOTE_NUMBER, noteNumber)
 			col.SetString(NOTE.BODY, body)
 		},
 	}
-	switch app.Dialect {
+	switch dialect {
 	case sq.DialectSQLite, sq.DialectPostgres:
 		insertQuery.Conflict.Fields = sq.Fields{NOTE.USER_ID, NOTE.NOTE_NUMBER}
 		insertQuery.Conflict.Resolution = sq.Assignments{
@@ -151,10 +766,560 @@ func (app *App) Note(w http.ResponseWriter, r *http.Request) {
 			NOTE.BODY.Set(NOTE.BODY.WithPrefix("new")),
 		}
 	}
-	_, err = sq.Exec(app.DB, insertQuery)
+	_, err = sq.ExecContext(ctx, tx, insertQuery)
+	if err != nil {
+		return err
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.
+		InsertInto(NOTE_REVISION).
+		ColumnValues(func(col *sq.Column) {
+			col.SetUUID(NOTE_REVISION.REVISION_ID, ulid.Make())
+			col.SetUUID(NOTE_REVISION.USER_ID, userID)
+			col.SetInt(NOTE_REVISION.NOTE_NUMBER, noteNumber)
+			col.SetString(NOTE_REVISION.BODY, body)
+		}).
+		SetDialect(dialect),
+	)
+	if err != nil {
+		return err
+	}
+	// The quota is checked after pruning, so that a user at their quota can
+	// still make edits that don't grow their notes.
+	prunedBytes, err := app.pruneNoteRevisions(ctx, tx, userID, noteNumber)
+	if err != nil {
+		return err
+	}
+	delta.NoteBytes -= prunedBytes
+	return app.updateUsage(ctx, tx, userID, delta)
+}
+
+// pruneNoteRevisions deletes the revisions of a note that are older than its
+// last maxNoteRevisions revisions and returns the size of their bodies.
+func (app *App) pruneNoteRevisions(ctx context.Context, tx *sql.Tx, userID ulid.ULID, noteNumber int) (int64, error) {
+	NOTE_REVISION := sq.New[NOTE_REVISION]("")
+	condition := sq.And(
+		NOTE_REVISION.USER_ID.EqUUID(userID),
+		NOTE_REVISION.NOTE_NUMBER.EqInt(noteNumber),
+	)
+	// The oldest revision that is kept, if the note has that many.
+	oldestKept, err := sq.FetchOneContext(ctx, tx, sq.
+		From(NOTE_REVISION).
+		Where(condition).
+		OrderBy(NOTE_REVISION.REVISION_ID.Desc()).
+		Limit(1).
+		Offset(maxNoteRevisions-1).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (revisionID ulid.ULID) {
+			row.UUIDField(&revisionID, NOTE_REVISION.REVISION_ID)
+			return revisionID
+		},
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	pruned := sq.And(
+		condition,
+		sq.Lt(NOTE_REVISION.REVISION_ID, sq.UUIDValue(oldestKept)),
+	)
+	prunedBytes, err := app.noteRevisionBytes(ctx, tx, pruned)
+	if err != nil {
+		return 0, err
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(NOTE_REVISION).
+		Where(pruned).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return prunedBytes, nil
+}
+
+// noteRevisionBytes returns the total size of the bodies of the revisions
+// matching predicate.
+func (app *App) noteRevisionBytes(ctx context.Context, tx *sql.Tx, predicate sq.Predicate) (int64, error) {
+	NOTE_REVISION := sq.New[NOTE_REVISION]("")
+	return sq.FetchOneContext(ctx, tx, sq.
+		From(NOTE_REVISION).
+		Where(predicate).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) int64 {
+			return row.Int64Field(sq.Expr("COALESCE(SUM({}), 0)", octetLength(app.Dialect, NOTE_REVISION.BODY)))
+		},
+	)
+}
+
+// noteHistory renders the revisions of a note. If ?from=<revisionID> and
+// ?to=<revisionID> are given, it also renders the line diff between the two
+// revisions.
+func (app *App) noteHistory(w http.ResponseWriter, r *http.Request, currentUserID ulid.ULID, noteNumber int) {
+	type Revision struct {
+		RevisionID string
+		CreatedAt  time.Time
+	}
+	type TemplateData struct {
+		NoteNumber int
+		Revisions  []Revision
+		From       string
+		To         string
+		Diff       []diffLine
+	}
+
+	templateData := TemplateData{NoteNumber: noteNumber}
+	NOTE_REVISION := sq.New[NOTE_REVISION]("")
+	revisions, err := sq.FetchAllContext(r.Context(), app.DB, sq.
+		From(NOTE_REVISION).
+		Where(
+			NOTE_REVISION.USER_ID.EqUUID(currentUserID),
+			NOTE_REVISION.NOTE_NUMBER.EqInt(noteNumber),
+		).
+		OrderBy(NOTE_REVISION.REVISION_ID.Desc()).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) Revision {
+			var revisionID ulid.ULID
+			row.UUIDField(&revisionID, NOTE_REVISION.REVISION_ID)
+			return Revision{
+				RevisionID: strings.ToLower(revisionID.String()),
+				CreatedAt:  ulid.Time(revisionID.Time()),
+			}
+		},
+	)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	templateData.Revisions = revisions
+
+	if r.Form.Has("from") || r.Form.Has("to") {
+		fromID, err := ulid.Parse(r.Form.Get("from"))
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, "invalid from revision")
+			return
+		}
+		toID, err := ulid.Parse(r.Form.Get("to"))
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, "invalid to revision")
+			return
+		}
+		bodies, err := sq.FetchAllContext(r.Context(), app.DB, sq.
+			From(NOTE_REVISION).
+			Where(
+				NOTE_REVISION.USER_ID.EqUUID(currentUserID),
+				NOTE_REVISION.NOTE_NUMBER.EqInt(noteNumber),
+				NOTE_REVISION.REVISION_ID.In([]any{sq.UUIDValue(fromID), sq.UUIDValue(toID)}),
+			).
+			SetDialect(app.Dialect),
+			func(row *sq.Row) (result struct {
+				RevisionID ulid.ULID
+				Body       string
+			}) {
+				row.UUIDField(&result.RevisionID, NOTE_REVISION.REVISION_ID)
+				result.Body = row.StringField(NOTE_REVISION.BODY)
+				return result
+			},
+		)
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		var fromBody, toBody string
+		var fromFound, toFound bool
+		for _, body := range bodies {
+			if body.RevisionID == fromID {
+				fromBody, fromFound = body.Body, true
+			}
+			if body.RevisionID == toID {
+				toBody, toFound = body.Body, true
+			}
+		}
+		if !fromFound || !toFound {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		templateData.From = strings.ToLower(fromID.String())
+		templateData.To = strings.ToLower(toID.String())
+		templateData.Diff = lineDiff(fromBody, toBody)
+	}
+
+	tmpl, err := template.ParseFiles("html/note_history.html")
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, templateData)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// readNoteBody reads the note body from a POST request. HTML forms submit the
+// body in the "body" form field, any other content type is treated as the raw
+// note body.
+func readNoteBody(w http.ResponseWriter, r *http.Request) (string, error) {
+	// Leave some room for the form encoding and the other form fields.
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxNoteSize)
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/x-www-form-urlencoded" || contentType == "multipart/form-data" {
+		err := r.ParseMultipartForm(1 << 20 /* 1MB */)
+		if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return "", err
+		}
+		return r.PostForm.Get("body"), nil
+	}
+	var b strings.Builder
+	_, err := io.Copy(&b, r.Body)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// nextNoteNumber allocates the next note number for the user. It must be
+// called inside a transaction: incrementing USERS.LAST_NOTE_NUMBER locks the
+// user's row until the transaction ends, so concurrent calls for the same user
+// are serialized and never hand out the same note number.
+func nextNoteNumber(ctx context.Context, tx *sql.Tx, dialect string, userID ulid.ULID) (int, error) {
+	USERS := sq.New[USERS]("")
+	NOTE := sq.New[NOTE]("")
+	// LAST_NOTE_NUMBER may lag behind notes that were created before the
+	// column existed, so never go below the largest existing note number.
+	greatest := "GREATEST"
+	if dialect == sq.DialectSQLite {
+		greatest = "MAX"
+	}
+	result, err := sq.ExecContext(ctx, tx, sq.
+		Update(USERS).
+		Set(USERS.LAST_NOTE_NUMBER.Setf(greatest+"({}, ({})) + 1",
+			USERS.LAST_NOTE_NUMBER,
+			sq.Select(sq.Expr("COALESCE(MAX({}), 0)", NOTE.NOTE_NUMBER)).
+				From(NOTE).
+				Where(NOTE.USER_ID.EqUUID(userID)),
+		)).
+		Where(USERS.USER_ID.EqUUID(userID)).
+		SetDialect(dialect),
+	)
+	if err != nil {
+		return 0, err
+	}
+	if result.RowsAffected == 0 {
+		return 0, fmt.Errorf("user %s does not exist", strings.ToLower(userID.String()))
+	}
+	noteNumber, err := sq.FetchOneContext(ctx, tx, sq.
+		From(USERS).
+		Where(USERS.USER_ID.EqUUID(userID)).
+		SetDialect(dialect),
+		func(row *sq.Row) int {
+			return row.IntField(USERS.LAST_NOTE_NUMBER)
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return noteNumber, nil
+}
+
+// notesPerPage is the number of notes shown on each page of the note list.
+const notesPerPage = 25
+
+// notePreviewLength is the number of characters of a note's body shown in the
+// note list.
+const notePreviewLength = 200
+
+// noteList renders the list of the current user's notes, or the notes
+// matching the search query if ?q=<query> is given. ?tag=<tag> narrows the
+// list (or the search) down to the notes with that tag. The list is paginated
+// using the note number as a keyset: ?after=<noteNumber> shows the notes that
+// come after <noteNumber> in the current sort order and ?before=<noteNumber>
+// shows the notes that come before it. ?sort=asc lists the oldest notes first,
+// otherwise the newest notes are listed first.
+func (app *App) noteList(w http.ResponseWriter, r *http.Request, currentUserID ulid.ULID) {
+	type Note struct {
+		NoteNumber int
+		Preview    string
+		Snippet    template.HTML
+		Tags       []string
+	}
+	type TemplateData struct {
+		Query string
+		Sort  string
+		// Tag is the tag that the notes are filtered by, if any.
+		Tag string
+		// Tags are all the tags on the user's notes.
+		Tags    []string
+		Notes   []Note
+		PrevURL string
+		NextURL string
+	}
+
+	templateData := TemplateData{Sort: "desc"}
+	templateData.Tag = normalizeTag(r.Form.Get("tag"))
+	var err error
+	templateData.Tags, err = app.userNoteTags(r.Context(), currentUserID)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	NOTE := sq.New[NOTE]("")
+
+	// Search results are ordered by relevance and are not paginated.
+	templateData.Query = strings.TrimSpace(r.Form.Get("q"))
+	if templateData.Query != "" {
+		results, err := app.searchNotes(r.Context(), currentUserID, templateData.Query, templateData.Tag)
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		noteNumbers := make([]any, len(results))
+		for i, result := range results {
+			noteNumbers[i] = result.NoteNumber
+		}
+		var tags map[int][]string
+		if len(results) > 0 {
+			tags, err = app.noteTags(r.Context(), currentUserID, NOTE.NOTE_NUMBER.In(noteNumbers))
+			if err != nil {
+				app.Error(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		for _, result := range results {
+			templateData.Notes = append(templateData.Notes, Note{
+				NoteNumber: result.NoteNumber,
+				Snippet:    result.Snippet,
+				Tags:       tags[result.NoteNumber],
+			})
+		}
+		tmpl, err := template.ParseFiles("html/notes.html")
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, templateData)
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		_, err = buf.WriteTo(w)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if r.Form.Get("sort") == "asc" {
+		templateData.Sort = "asc"
+	}
+	var after, before int
+	if s := r.Form.Get("after"); s != "" {
+		after, err = strconv.Atoi(s)
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, "invalid after parameter")
+			return
+		}
+	} else if s := r.Form.Get("before"); s != "" {
+		before, err = strconv.Atoi(s)
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, "invalid before parameter")
+			return
+		}
+	}
+
+	// When paging backwards we fetch the notes in the opposite order (so that
+	// the LIMIT picks the notes closest to the cursor) and reverse them
+	// afterwards.
+	backwards := before != 0
+	ascending := templateData.Sort == "asc"
+	if backwards {
+		ascending = !ascending
+	}
+	predicates := []sq.Predicate{
+		NOTE.USER_ID.EqUUID(currentUserID),
+		NOTE.DELETED_AT.IsNull(),
+	}
+	if templateData.Tag != "" {
+		predicates = append(predicates, noteTagged(NOTE, templateData.Tag))
+	}
+	switch {
+	case after != 0 && ascending:
+		predicates = append(predicates, NOTE.NOTE_NUMBER.GtInt(after))
+	case after != 0 && !ascending:
+		predicates = append(predicates, NOTE.NOTE_NUMBER.LtInt(after))
+	case before != 0 && ascending:
+		predicates = append(predicates, NOTE.NOTE_NUMBER.GtInt(before))
+	case before != 0 && !ascending:
+		predicates = append(predicates, NOTE.NOTE_NUMBER.LtInt(before))
+	}
+	order := NOTE.NOTE_NUMBER.Desc()
+	if ascending {
+		order = NOTE.NOTE_NUMBER.Asc()
+	}
+	notes, err := sq.FetchAllContext(r.Context(), app.DB, sq.
+		From(NOTE).
+		Where(predicates...).
+		OrderBy(order).
+		Limit(notesPerPage+1).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) Note {
+			return Note{
+				NoteNumber: row.IntField(NOTE.NOTE_NUMBER),
+				Preview:    row.String("SUBSTR({}, 1, {})", NOTE.BODY, notePreviewLength+1),
+			}
+		},
+	)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	hasMore := len(notes) > notesPerPage
+	if hasMore {
+		notes = notes[:notesPerPage]
+	}
+	if backwards {
+		for i, j := 0, len(notes)-1; i < j; i, j = i+1, j-1 {
+			notes[i], notes[j] = notes[j], notes[i]
+		}
+	}
+	if len(notes) > 0 {
+		// The tags of the notes on this page, which lie between the
+		// first and last note numbers of the page.
+		first, last := notes[0].NoteNumber, notes[len(notes)-1].NoteNumber
+		if first > last {
+			first, last = last, first
+		}
+		tags, err := app.noteTags(r.Context(), currentUserID, sq.And(
+			NOTE.NOTE_NUMBER.GeInt(first),
+			NOTE.NOTE_NUMBER.LeInt(last),
+		))
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		for i := range notes {
+			notes[i].Tags = tags[notes[i].NoteNumber]
+		}
+	}
+	for i := range notes {
+		notes[i].Preview = notePreview(notes[i].Preview)
+	}
+	templateData.Notes = notes
+
+	// Work out the links to the previous and next pages.
+	if len(notes) > 0 {
+		query := url.Values{}
+		if templateData.Sort == "asc" {
+			query.Set("sort", "asc")
+		}
+		if templateData.Tag != "" {
+			query.Set("tag", templateData.Tag)
+		}
+		hasPrev := after != 0 || (backwards && hasMore)
+		hasNext := before != 0 || (!backwards && hasMore)
+		if hasPrev {
+			query.Set("before", strconv.Itoa(notes[0].NoteNumber))
+			templateData.PrevURL = "/note/?" + query.Encode()
+			query.Del("before")
+		}
+		if hasNext {
+			query.Set("after", strconv.Itoa(notes[len(notes)-1].NoteNumber))
+			templateData.NextURL = "/note/?" + query.Encode()
+		}
+	}
+
+	tmpl, err := template.ParseFiles("html/notes.html")
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, templateData)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// noteTrash renders the notes in the current user's trash.
+func (app *App) noteTrash(w http.ResponseWriter, r *http.Request, currentUserID ulid.ULID) {
+	type Note struct {
+		NoteNumber int
+		Preview    string
+		DeletedAt  time.Time
+		PurgeAt    time.Time
+	}
+	type TemplateData struct {
+		Notes []Note
+	}
+
+	NOTE := sq.New[NOTE]("")
+	notes, err := sq.FetchAllContext(r.Context(), app.DB, sq.
+		From(NOTE).
+		Where(
+			NOTE.USER_ID.EqUUID(currentUserID),
+			NOTE.DELETED_AT.IsNotNull(),
+		).
+		OrderBy(NOTE.DELETED_AT.Desc()).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) Note {
+			note := Note{
+				NoteNumber: row.IntField(NOTE.NOTE_NUMBER),
+				Preview:    row.String("SUBSTR({}, 1, {})", NOTE.BODY, notePreviewLength+1),
+				DeletedAt:  row.TimeField(NOTE.DELETED_AT),
+			}
+			note.PurgeAt = note.DeletedAt.Add(app.TrashRetention)
+			return note
+		},
+	)
 	if err != nil {
 		app.Error(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	http.Redirect(w, r, "/note/"+strconv.Itoa(noteNumber), http.StatusFound)
+	for i := range notes {
+		notes[i].Preview = notePreview(notes[i].Preview)
+	}
+	tmpl, err := template.ParseFiles("html/note_trash.html")
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, TemplateData{Notes: notes})
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// notePreview collapses the whitespace in s and truncates it to
+// notePreviewLength characters. s is expected to be the first
+// notePreviewLength+1 characters of the note body, so that we can tell if the
+// body was cut short.
+func notePreview(s string) string {
+	truncated := utf8.RuneCountInString(s) > notePreviewLength
+	s = strings.Join(strings.Fields(s), " ")
+	if !truncated {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) > notePreviewLength {
+		runes = runes[:notePreviewLength]
+	}
+	return string(runes) + "…"
 }
@@ -0,0 +1,31 @@
+package notebrew
+
+import "testing"
+
+func TestETagMatches(t *testing.T) {
+	type TestTable struct {
+		header string
+		weak   bool
+		want   bool
+	}
+
+	const etag = `"0123456789abcdef"`
+	tests := []TestTable{
+		{header: `"0123456789abcdef"`, weak: false, want: true},
+		{header: `"0123456789abcdef"`, weak: true, want: true},
+		{header: `W/"0123456789abcdef"`, weak: false, want: false},
+		{header: `W/"0123456789abcdef"`, weak: true, want: true},
+		{header: `"fedcba9876543210", "0123456789abcdef"`, weak: false, want: true},
+		{header: `W/"0123456789abcdef", "fedcba9876543210"`, weak: false, want: false},
+		{header: `*`, weak: false, want: true},
+		{header: `"fedcba9876543210"`, weak: true, want: false},
+		{header: ``, weak: true, want: false},
+	}
+
+	for _, tt := range tests {
+		got := etagMatches(tt.header, etag, tt.weak)
+		if got != tt.want {
+			t.Errorf("%q (weak: %v): got %v, want %v", tt.header, tt.weak, got, tt.want)
+		}
+	}
+}
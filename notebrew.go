@@ -2,6 +2,7 @@ package notebrew
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"embed"
 	"encoding/base64"
@@ -19,6 +20,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -41,9 +43,47 @@ type App struct {
 	DB      *sql.DB
 	Dialect string
 	ImageFS FS
+
+	// TrashRetention is how long a note stays in the trash before it is
+	// permanently deleted.
+	TrashRetention time.Duration
+
+	// ImageGracePeriod is how old an image that isn't referenced by any note
+	// must be before it is garbage collected.
+	ImageGracePeriod time.Duration
+
+	// DefaultQuota is the quota of users that don't have a quota of their
+	// own.
+	DefaultQuota Quota
+
+	// BaseURL is the URL that notebrew is served from, such as
+	// https://example.com, used where absolute URLs are needed (like in
+	// feeds). If it is empty, the scheme and host of the request are used.
+	BaseURL string
+
+	// HCaptchaSiteKey and HCaptchaSecret are the hCaptcha keys of the site,
+	// used to keep bots from registering and from commenting without
+	// logging in. They default to hCaptcha's test keys, which pass every
+	// challenge, so readers can't comment without logging in until they are
+	// set (see HCaptchaTestKeys).
+	HCaptchaSiteKey string
+	HCaptchaSecret  string
+
+	// RobotsTxt is served as /robots.txt. If it is empty, a robots.txt that
+	// keeps crawlers out of the pages for logged in users and points them
+	// to /sitemap.xml is served instead.
+	RobotsTxt string
+
+	// domainCache remembers which blogs hosts are the domains of, see
+	// hostBlog.
+	domainCache domainCache
 }
 
-func NewApp(databaseURL string, dataDir string) (*App, error) {
+// NewApp returns a new App. If databaseURL is empty, an SQLite database in
+// dataDir is used. If imageURL is empty, images are stored in dataDir,
+// otherwise imageURL must be an s3:// URL (see ParseS3URL) of the bucket to
+// store images in.
+func NewApp(databaseURL string, dataDir string, imageURL string) (*App, error) {
 	if dataDir == "" {
 		userHomeDir, err := os.UserHomeDir()
 		if err != nil {
@@ -81,19 +121,56 @@ func NewApp(databaseURL string, dataDir string) (*App, error) {
 	if err != nil {
 		return nil, err
 	}
-	imageDir := filepath.Join(dataDir, "image")
-	err = os.MkdirAll(imageDir, 0755)
-	if err != nil {
-		return nil, err
+	var imageFS FS
+	if imageURL != "" {
+		imageFS, err = ParseS3URL(imageURL)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		imageDir := filepath.Join(dataDir, "image")
+		err = os.MkdirAll(imageDir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		imageFS = NestedDirFS(imageDir)
 	}
 	app := &App{
-		DB:      db,
-		Dialect: dialect,
-		ImageFS: NestedDirFS(imageDir),
+		DB:               db,
+		Dialect:          dialect,
+		ImageFS:          imageFS,
+		TrashRetention:   30 * 24 * time.Hour,
+		ImageGracePeriod: 24 * time.Hour,
+		DefaultQuota: Quota{
+			ImageBytes: 1 << 30,
+			Notes:      10000,
+			NoteBytes:  100 << 20,
+		},
+		HCaptchaSiteKey: hCaptchaTestSiteKey,
+		HCaptchaSecret:  hCaptchaTestSecret,
+	}
+	// Posts written before posts had slugs are given one, since slugs can't
+	// be generated by the migrations.
+	err = app.AssignPostSlugs(context.Background())
+	if err != nil {
+		return nil, err
 	}
 	return app, nil
 }
 
+// hCaptchaTestSiteKey and hCaptchaTestSecret are hCaptcha's test keys, see
+// https://docs.hcaptcha.com/#integration-testing-test-keys.
+const (
+	hCaptchaTestSiteKey = "10000000-ffff-ffff-ffff-000000000001"
+	hCaptchaTestSecret  = "0x0000000000000000000000000000000000000000"
+)
+
+// HCaptchaTestKeys reports whether the site uses hCaptcha's test keys, which
+// let every bot through.
+func (app *App) HCaptchaTestKeys() bool {
+	return app.HCaptchaSiteKey == hCaptchaTestSiteKey || app.HCaptchaSecret == hCaptchaTestSecret
+}
+
 func (app *App) Cleanup() error {
 	return app.DB.Close()
 }
@@ -127,8 +204,9 @@ func (app *App) Redirect(w http.ResponseWriter, r *http.Request, destURL string,
 		log.Println(err)
 	}
 	http.SetCookie(w, &http.Cookie{
-		Name:     base64.URLEncoding.EncodeToString([]byte(u.Path)),
+		Name:     base64.RawURLEncoding.EncodeToString([]byte(u.Path)),
 		Value:    strings.ToLower(sessionID.String()),
+		Path:     u.Path,
 		MaxAge:   3,
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
@@ -137,9 +215,10 @@ func (app *App) Redirect(w http.ResponseWriter, r *http.Request, destURL string,
 }
 
 func (app *App) Flash(w http.ResponseWriter, r *http.Request, dest any) error {
-	name := base64.URLEncoding.EncodeToString([]byte(r.URL.Path))
+	name := base64.RawURLEncoding.EncodeToString([]byte(r.URL.Path))
 	http.SetCookie(w, &http.Cookie{
 		Name:   name,
+		Path:   r.URL.Path,
 		MaxAge: -1,
 	})
 	cookie, err := r.Cookie(name)
@@ -183,6 +262,18 @@ var errTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
 
 func (app *App) Error(w http.ResponseWriter, r *http.Request, code int, msg any) {
 	_, file, line, _ := runtime.Caller(1)
+	// The errors behind 5xx responses come from the database or the file
+	// system and are no business of the user, so they are only logged.
+	// Other errors have no exported fields, so they would be lost when the
+	// data is JSON encoded into the flash session.
+	if err, ok := msg.(error); ok {
+		if code >= 500 {
+			log.Printf("%s:%d: %v", file, line, err)
+			msg = nil
+		} else {
+			msg = err.Error()
+		}
+	}
 	data := map[string]any{
 		"Title":  strconv.Itoa(code) + " " + http.StatusText(code),
 		"Caller": file + ":" + strconv.Itoa(line),
@@ -200,12 +291,13 @@ func (app *App) Error(w http.ResponseWriter, r *http.Request, code int, msg any)
 func (app *App) ErrorPage(w http.ResponseWriter, r *http.Request) {
 	data := make(map[string]any)
 	app.Flash(w, r, &data)
-	code, ok := data["Code"].(int)
+	// Numbers in the flash data are decoded from JSON as float64.
+	code, ok := data["Code"].(float64)
 	if !ok {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	w.WriteHeader(code)
+	w.WriteHeader(int(code))
 	_ = errTemplate.Execute(w, data)
 }
 
@@ -285,9 +377,27 @@ func (app *App) CurrentUserID(r *http.Request) (ulid.ULID, bool) {
 	return userID, true
 }
 
+// FS is a flat store of files whose names start with at least 26 random
+// characters, such as a ULID or a hex encoded hash.
 type FS interface {
+	// Open opens the named file for reading.
 	Open(name string) (fs.File, error)
+
+	// OpenWriter opens the named file for writing. Nothing is visible under
+	// that name until the writer is closed, at which point the file is
+	// created or replaced in one step. If a write fails, closing the writer
+	// discards the file and returns the error.
 	OpenWriter(name string) (io.WriteCloser, error)
+
+	// Stat returns the fs.FileInfo of the named file.
+	Stat(name string) (fs.FileInfo, error)
+
+	// Remove removes the named file.
+	Remove(name string) error
+
+	// ReadDir lists all the files sorted by name. Since the file names are
+	// flat, the only directory is ".".
+	ReadDir(name string) ([]fs.DirEntry, error)
 }
 
 type dirFS struct {
@@ -299,30 +409,194 @@ func DirFS(dir string) FS {
 	return dirFS{dir: dir}
 }
 
+// NestedDirFS returns an FS that spreads its files over subdirectories named
+// after the 25th and 26th characters of each name, so that no directory
+// grows too large.
 func NestedDirFS(dir string) FS {
 	return dirFS{dir: dir, nested: true}
 }
 
-func (d dirFS) Open(name string) (fs.File, error) {
-	if len(name) < ulid.EncodedSize {
-		return nil, fmt.Errorf("invalid name")
+// filePath returns the path of the named file on disk.
+func (d dirFS) filePath(name string) (string, error) {
+	if len(name) < ulid.EncodedSize || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid name")
 	}
 	if d.nested {
 		name = path.Join(name[ulid.EncodedSize-2:ulid.EncodedSize], name)
 	}
-	return os.Open(path.Join(d.dir, name))
+	return path.Join(d.dir, name), nil
+}
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filePath)
 }
 
 func (d dirFS) OpenWriter(name string) (io.WriteCloser, error) {
-	if len(name) < ulid.EncodedSize {
-		return nil, fmt.Errorf("invalid name")
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	// Write to a temporary file next to the destination and rename it over
+	// the destination on Close, so that a crash mid-write never leaves a
+	// partially written file behind under the real name. The temporary file
+	// starts with a "." so that ReadDir skips it.
+	file, err := os.CreateTemp(path.Dir(filePath), "."+name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{file: file, destPath: filePath}, nil
+}
+
+// atomicFile is a temporary file that is renamed to destPath when closed.
+type atomicFile struct {
+	file     *os.File
+	destPath string
+	err      error
+}
+
+func (f *atomicFile) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	n, err := f.file.Write(p)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *atomicFile) Close() error {
+	if f.err == nil {
+		f.err = f.file.Chmod(0644)
+	}
+	if f.err == nil {
+		f.err = f.file.Sync()
+	}
+	closeErr := f.file.Close()
+	if f.err == nil {
+		f.err = closeErr
+	}
+	if f.err == nil {
+		f.err = os.Rename(f.file.Name(), f.destPath)
 	}
+	if f.err != nil {
+		os.Remove(f.file.Name())
+		return f.err
+	}
+	// Make sure nothing is written to or closed twice.
+	f.err = os.ErrClosed
+	return nil
+}
+
+func (d dirFS) Stat(name string) (fs.FileInfo, error) {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(filePath)
+}
+
+func (d dirFS) Remove(name string) error {
+	filePath, err := d.filePath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+// removeTempFiles removes the temporary files of writes that were never
+// finished (because the process crashed mid-write, for example) and that were
+// last modified before cutoff. It returns the names of the files removed, or
+// that would have been removed if dryRun is true.
+func (d dirFS) removeTempFiles(cutoff time.Time, dryRun bool) ([]string, error) {
+	dirs := []string{d.dir}
 	if d.nested {
-		name = path.Join(name[ulid.EncodedSize-2:ulid.EncodedSize], name)
+		entries, err := os.ReadDir(d.dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				dirs = append(dirs, path.Join(d.dir, entry.Name()))
+			}
+		}
+	}
+	var names []string
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return names, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".tmp") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return names, err
+			}
+			if !info.ModTime().Before(cutoff) {
+				continue
+			}
+			names = append(names, name)
+			if dryRun {
+				continue
+			}
+			err = os.Remove(path.Join(dir, name))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return names, err
+			}
+		}
+	}
+	return names, nil
+}
+
+func (d dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
 	}
-	err := os.MkdirAll(d.dir, 0755)
+	entries, err := os.ReadDir(d.dir)
 	if err != nil {
 		return nil, err
 	}
-	return os.OpenFile(path.Join(d.dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	var files []fs.DirEntry
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if !d.nested {
+			if !entry.IsDir() {
+				files = append(files, entry)
+			}
+			continue
+		}
+		if !entry.IsDir() {
+			continue
+		}
+		subEntries, err := os.ReadDir(path.Join(d.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, subEntry := range subEntries {
+			if !subEntry.IsDir() && !strings.HasPrefix(subEntry.Name(), ".") {
+				files = append(files, subEntry)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	return files, nil
 }
@@ -2,25 +2,69 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/notebrew/notebrew"
+	"github.com/oklog/ulid/v2"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	app, err := notebrew.NewApp(os.Getenv("DATABASE_URL"), os.Getenv("NOTEBREW_DATA"))
+	app, err := notebrew.NewApp(os.Getenv("DATABASE_URL"), os.Getenv("NOTEBREW_DATA"), os.Getenv("NOTEBREW_IMAGE_URL"))
 	if err != nil {
 		log.Fatal(err)
 	}
+	app.BaseURL = strings.TrimSuffix(os.Getenv("NOTEBREW_BASE_URL"), "/")
+	if siteKey, secret := os.Getenv("NOTEBREW_HCAPTCHA_SITE_KEY"), os.Getenv("NOTEBREW_HCAPTCHA_SECRET"); siteKey != "" || secret != "" {
+		if siteKey == "" || secret == "" {
+			log.Fatal("NOTEBREW_HCAPTCHA_SITE_KEY and NOTEBREW_HCAPTCHA_SECRET must be set together")
+		}
+		app.HCaptchaSiteKey, app.HCaptchaSecret = siteKey, secret
+	}
+	if s := os.Getenv("NOTEBREW_TRASH_RETENTION"); s != "" {
+		app.TrashRetention, err = time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("NOTEBREW_TRASH_RETENTION: %v", err)
+		}
+	}
+	if s := os.Getenv("NOTEBREW_IMAGE_GRACE_PERIOD"); s != "" {
+		app.ImageGracePeriod, err = time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("NOTEBREW_IMAGE_GRACE_PERIOD: %v", err)
+		}
+	}
+	if name := os.Getenv("NOTEBREW_ROBOTS_TXT"); name != "" {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			log.Fatalf("NOTEBREW_ROBOTS_TXT: %v", err)
+		}
+		app.RobotsTxt = string(b)
+	}
+	if len(os.Args) > 1 {
+		defer app.Cleanup()
+		switch os.Args[1] {
+		case "gc":
+			err = gc(app, os.Args[2:])
+		case "export-site":
+			err = exportSite(app, os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	server := http.Server{
 		Addr:    os.Getenv("NOTEBREW_ADDR"),
 		Handler: app.Handler(),
@@ -28,11 +72,71 @@ func main() {
 	if server.Addr == "" {
 		server.Addr = "localhost:7070"
 	}
+	if app.HCaptchaTestKeys() {
+		log.Println("warning: using hCaptcha's test keys, which let every bot register; readers can't comment without logging in until NOTEBREW_HCAPTCHA_SITE_KEY and NOTEBREW_HCAPTCHA_SECRET are set")
+	}
 	fmt.Println("Listening on " + server.Addr)
 	go server.ListenAndServe()
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	go app.RunBackgroundJobs(jobsCtx)
 	<-stop
+	stopJobs()
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	_ = server.Shutdown(ctx)
 	_ = app.Cleanup()
 }
+
+// gc runs the image garbage collector once and prints what it collected.
+//
+//	notebrew gc [-dry-run] [-grace-period <duration>]
+func gc(app *notebrew.App, args []string) error {
+	flagset := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flagset.Bool("dry-run", false, "list the orphaned images and files without deleting them")
+	gracePeriod := flagset.Duration("grace-period", app.ImageGracePeriod, "only collect images and files older than this")
+	err := flagset.Parse(args)
+	if err != nil {
+		return err
+	}
+	report, err := app.CollectGarbage(context.Background(), *gracePeriod, *dryRun)
+	for _, imageID := range report.Images {
+		fmt.Println("image " + imageID)
+	}
+	for _, name := range report.Files {
+		fmt.Println("file " + name)
+	}
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("found %d orphaned images and %d orphaned files (dry run, nothing was deleted)\n", len(report.Images), len(report.Files))
+	} else {
+		fmt.Printf("deleted %d orphaned images and %d orphaned files\n", len(report.Images), len(report.Files))
+	}
+	return nil
+}
+
+// exportSite exports a blog as a static site.
+//
+//	notebrew export-site -base-url <url> <blogID> <output directory or .zip file>
+func exportSite(app *notebrew.App, args []string) error {
+	flagset := flag.NewFlagSet("export-site", flag.ContinueOnError)
+	baseURL := flagset.String("base-url", "", "the URL the site will be hosted at, used for the links in the feeds")
+	err := flagset.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flagset.NArg() != 2 {
+		return fmt.Errorf("usage: notebrew export-site -base-url <url> <blogID> <output directory or .zip file>")
+	}
+	blogID, err := ulid.Parse(flagset.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid blog ID %q", flagset.Arg(0))
+	}
+	err = app.ExportSite(context.Background(), blogID, *baseURL, flagset.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Println("exported blog " + strings.ToLower(blogID.String()) + " to " + flagset.Arg(1))
+	return nil
+}
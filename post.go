@@ -0,0 +1,983 @@
+package notebrew
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// maxPostSize is the maximum size of a post body in bytes, matching the
+// length of POST.BODY.
+const maxPostSize = 65536
+
+// errPostTooLarge is returned when a post body is larger than maxPostSize.
+var errPostTooLarge = fmt.Errorf("post is larger than %s", formatBytes(maxPostSize))
+
+// The statuses of a post. Drafts are only seen by the owner of the blog.
+// Scheduled posts are seen by everyone once their publish time has passed,
+// after which PublishScheduledPosts marks them as published.
+const (
+	postDraft     = "draft"
+	postScheduled = "scheduled"
+	postPublished = "published"
+)
+
+func (app *App) Post(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		app.Error(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/")
+	if segments[0] != "post" || len(segments) > 3 {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	if len(segments) == 3 {
+		if segments[2] != "delete" {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		if r.Method != "POST" {
+			app.Error(w, r, http.StatusMethodNotAllowed, nil)
+			return
+		}
+	}
+
+	// Posts can be read by anyone, only writing them requires logging in.
+	if len(segments) == 2 && r.Method == "GET" && !r.URL.Query().Has("edit") {
+		app.servePost(w, r, segments[1])
+		return
+	}
+
+	currentUserID, loggedIn := app.CurrentUserID(r)
+	if !loggedIn {
+		app.Redirect(w, r, "/login", map[string]string{
+			"RedirectTo": r.URL.Path,
+		})
+		return
+	}
+
+	if len(segments) == 1 {
+		if r.Method == "GET" {
+			if !r.URL.Query().Has("new") {
+				http.Redirect(w, r, "/blog/", http.StatusFound)
+				return
+			}
+			blogID, err := ulid.Parse(r.URL.Query().Get("blog"))
+			if err != nil {
+				app.Error(w, r, http.StatusBadRequest, "invalid blog")
+				return
+			}
+			blog, err := app.fetchBlog(r.Context(), blogID)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					app.Error(w, r, http.StatusNotFound, nil)
+					return
+				}
+				app.Error(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if blog.UserID != currentUserID {
+				app.Error(w, r, http.StatusForbidden, nil)
+				return
+			}
+			app.postEditor(w, r, postEditorData{Blog: blog, Status: postPublished})
+			return
+		}
+
+		// Create a new post.
+		form, err := readPostForm(w, r)
+		if err != nil {
+			app.postFormError(w, r, err)
+			return
+		}
+		blogID, err := ulid.Parse(r.PostForm.Get("blog_id"))
+		if err != nil {
+			app.Error(w, r, http.StatusBadRequest, "invalid blog")
+			return
+		}
+		blog, err := app.fetchBlog(r.Context(), blogID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				app.Error(w, r, http.StatusNotFound, nil)
+				return
+			}
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if blog.UserID != currentUserID {
+			app.Error(w, r, http.StatusForbidden, nil)
+			return
+		}
+		form.schedule(time.Time{})
+		slug, err := app.createPost(r.Context(), blog, form)
+		if err != nil {
+			if errors.Is(err, errSlugTaken) {
+				app.Error(w, r, http.StatusConflict, err)
+				return
+			}
+			if isQuotaError(err) {
+				app.Error(w, r, http.StatusInsufficientStorage, err)
+				return
+			}
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, r, siteLinks{BlogID: blog.BlogIDString()}.Post(slug), http.StatusFound)
+		return
+	}
+
+	postID, err := ulid.Parse(segments[1])
+	if err != nil {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	post, err := app.fetchPost(r.Context(), postID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if post.Blog.UserID != currentUserID {
+		app.Error(w, r, http.StatusForbidden, nil)
+		return
+	}
+
+	if r.Method == "GET" {
+		templateData := postEditorData{
+			Blog:   post.Blog,
+			PostID: post.PostIDString(),
+			Title:  post.Title,
+			Body:   post.Body,
+			Slug:   post.Slug,
+			Status: post.Status,
+			Tags:   strings.Join(post.Tags, ", "),
+		}
+		if !post.PublishAt.IsZero() {
+			templateData.PublishAt = post.PublishAt.UTC().Format(publishAtLayout)
+		}
+		app.postEditor(w, r, templateData)
+		return
+	}
+
+	// Delete the post.
+	if len(segments) == 3 {
+		err = app.deletePost(r.Context(), post)
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, r, "/blog/"+post.Blog.BlogIDString()+"/", http.StatusFound)
+		return
+	}
+
+	// Update the post.
+	form, err := readPostForm(w, r)
+	if err != nil {
+		app.postFormError(w, r, err)
+		return
+	}
+	form.schedule(post.PublishAt)
+	slug, err := app.updatePost(r.Context(), post, form)
+	if err != nil {
+		if errors.Is(err, errSlugTaken) {
+			app.Error(w, r, http.StatusConflict, err)
+			return
+		}
+		if isQuotaError(err) {
+			app.Error(w, r, http.StatusInsufficientStorage, err)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	http.Redirect(w, r, siteLinks{BlogID: post.Blog.BlogIDString()}.Post(slug), http.StatusFound)
+}
+
+// createPost creates a post in a blog and returns its slug. A post without a
+// slug gets one generated from its title, made unique within the blog if
+// needed. It returns errSlugTaken if the slug given is already used by
+// another post of the blog.
+func (app *App) createPost(ctx context.Context, blog Blog, form postForm) (slug string, err error) {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	postID := ulid.Make()
+	slug, err = app.postFormSlug(ctx, tx, blog.BlogID, postID, form)
+	if err != nil {
+		return "", err
+	}
+	err = app.claimPostSlug(ctx, tx, blog.BlogID, postID, "", slug)
+	if err != nil {
+		return "", err
+	}
+	err = app.updateUsage(ctx, tx, blog.UserID, Quota{NoteBytes: int64(len(form.Body))})
+	if err != nil {
+		return "", err
+	}
+	POST := sq.New[POST]("")
+	_, err = sq.ExecContext(ctx, tx, sq.
+		InsertInto(POST).
+		ColumnValues(func(col *sq.Column) {
+			col.SetUUID(POST.POST_ID, postID)
+			col.SetUUID(POST.BLOG_ID, blog.BlogID)
+			col.SetString(POST.TITLE, form.Title)
+			col.SetString(POST.BODY, form.Body)
+			col.SetString(POST.STATUS, form.Status)
+			if !form.PublishAt.IsZero() {
+				col.SetTime(POST.PUBLISH_AT, form.PublishAt)
+			}
+			col.SetString(POST.SLUG, slug)
+		}).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return "", err
+	}
+	if len(form.Tags) > 0 {
+		err = app.setPostTags(ctx, tx, blog.UserID, postID, form.Tags)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+	return slug, nil
+}
+
+// updatePost updates a post with the submitted form and returns its slug. A
+// post keeps its slug unless a different one is given, in which case its old
+// slug redirects to the new one. Its tags are left alone if the form had no
+// tags field. It returns errSlugTaken if the slug given is already used by
+// another post of the blog.
+func (app *App) updatePost(ctx context.Context, post Post, form postForm) (slug string, err error) {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	slug = post.Slug
+	if form.Slug != "" {
+		slug, err = app.postFormSlug(ctx, tx, post.Blog.BlogID, post.PostID, form)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = app.claimPostSlug(ctx, tx, post.Blog.BlogID, post.PostID, post.Slug, slug)
+	if err != nil {
+		return "", err
+	}
+	err = app.updateUsage(ctx, tx, post.Blog.UserID, Quota{NoteBytes: int64(len(form.Body) - len(post.Body))})
+	if err != nil {
+		return "", err
+	}
+	POST := sq.New[POST]("")
+	publishAt := POST.PUBLISH_AT.Set(nil)
+	if !form.PublishAt.IsZero() {
+		publishAt = POST.PUBLISH_AT.SetTime(form.PublishAt)
+	}
+	_, err = sq.ExecContext(ctx, tx, sq.
+		Update(POST).
+		Set(
+			POST.TITLE.SetString(form.Title),
+			POST.BODY.SetString(form.Body),
+			POST.UPDATED_AT.SetTime(time.Now().UTC()),
+			POST.STATUS.SetString(form.Status),
+			publishAt,
+			POST.SLUG.SetString(slug),
+		).
+		Where(POST.POST_ID.EqUUID(post.PostID)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return "", err
+	}
+	if form.Tags != nil {
+		err = app.setPostTags(ctx, tx, post.Blog.UserID, post.PostID, form.Tags)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+	return slug, nil
+}
+
+// postFormSlug returns the slug for a submitted post: the slug given in the
+// form, which must not be used by another post of the blog, or else one
+// generated from the title.
+func (app *App) postFormSlug(ctx context.Context, tx *sql.Tx, blogID ulid.ULID, postID ulid.ULID, form postForm) (string, error) {
+	if form.Slug == "" {
+		return app.uniquePostSlug(ctx, tx, blogID, postID, slugify(form.Title))
+	}
+	slug, err := app.uniquePostSlug(ctx, tx, blogID, postID, form.Slug)
+	if err != nil {
+		return "", err
+	}
+	if slug != form.Slug {
+		return "", errSlugTaken
+	}
+	return slug, nil
+}
+
+// deletePost deletes a post along with its slug history. Its tags and comments
+// are deleted along with it by the foreign keys of POST_TAG and COMMENT.
+func (app *App) deletePost(ctx context.Context, post Post) error {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	postID := post.PostID
+	POST_SLUG_HISTORY := sq.New[POST_SLUG_HISTORY]("")
+	_, err = sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(POST_SLUG_HISTORY).
+		Where(POST_SLUG_HISTORY.POST_ID.EqUUID(postID)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	POST := sq.New[POST]("")
+	_, err = sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(POST).
+		Where(POST.POST_ID.EqUUID(postID)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	err = app.updateUsage(ctx, tx, post.Blog.UserID, Quota{NoteBytes: -int64(len(post.Body))})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Post is a post as it is stored in POST, along with the blog it belongs to.
+type Post struct {
+	PostID ulid.ULID
+	Blog   Blog
+	Title  string
+	Body   string
+	// SourceNoteNumber is the number of the note the post was published
+	// from, or 0 if it was written directly.
+	SourceNoteNumber int
+	// EditedAt is when the post was last edited, or the zero time if it
+	// hasn't been edited since it was published.
+	EditedAt time.Time
+	// Status is postDraft, postScheduled or postPublished.
+	Status string
+	// PublishAt is when the post is to be (or was) published, or the zero
+	// time if it is a draft.
+	PublishAt time.Time
+	// Slug identifies the post in its URL, /blog/<blogID>/<slug>.
+	Slug string
+	// Tags are the tags of the post in alphabetical order.
+	Tags []string
+}
+
+// PostIDString returns the post ID as it appears in URLs.
+func (post Post) PostIDString() string {
+	return strings.ToLower(post.PostID.String())
+}
+
+// PublishedAt returns the time the post is to be (or was) published. Drafts
+// don't have a publish time, so it is the time they were created instead.
+func (post Post) PublishedAt() time.Time {
+	if post.PublishAt.IsZero() {
+		return ulid.Time(post.PostID.Time())
+	}
+	return post.PublishAt
+}
+
+// UpdatedAt returns the time the post was last changed, which for the
+// readers of a blog is no earlier than when it was published.
+func (post Post) UpdatedAt() time.Time {
+	if post.EditedAt.Before(post.PublishedAt()) {
+		return post.PublishedAt()
+	}
+	return post.EditedAt
+}
+
+// Visible reports whether the post can be read by anyone, which is when it
+// isn't a draft and its publish time has passed.
+func (post Post) Visible() bool {
+	return post.Status != postDraft && !post.PublishAt.After(time.Now())
+}
+
+// Scheduled reports whether the post is waiting for its publish time.
+func (post Post) Scheduled() bool {
+	return post.Status != postDraft && post.PublishAt.After(time.Now())
+}
+
+// visiblePosts matches the posts that can be read by anyone, see
+// Post.Visible.
+func visiblePosts(POST POST) sq.Predicate {
+	return sq.And(
+		POST.STATUS.NeString(postDraft),
+		POST.PUBLISH_AT.LeTime(time.Now().UTC()),
+	)
+}
+
+// fetchPost fetches a post and its blog by the post ID. It returns
+// sql.ErrNoRows if there is no such post.
+func (app *App) fetchPost(ctx context.Context, postID ulid.ULID) (Post, error) {
+	POST := sq.New[POST]("")
+	return app.fetchPostWhere(ctx, POST.POST_ID.EqUUID(postID))
+}
+
+// fetchPostBySlug fetches a post and its blog by the blog ID and the current
+// slug of the post. It returns sql.ErrNoRows if there is no such post.
+func (app *App) fetchPostBySlug(ctx context.Context, blogID ulid.ULID, slug string) (Post, error) {
+	POST := sq.New[POST]("")
+	return app.fetchPostWhere(ctx, sq.And(
+		POST.BLOG_ID.EqUUID(blogID),
+		POST.SLUG.EqString(slug),
+	))
+}
+
+func (app *App) fetchPostWhere(ctx context.Context, predicate sq.Predicate) (Post, error) {
+	POST := sq.New[POST]("")
+	BLOG := sq.New[BLOG]("")
+	post, err := sq.FetchOneContext(ctx, app.DB, sq.
+		From(POST).
+		Join(BLOG, BLOG.BLOG_ID.Eq(POST.BLOG_ID)).
+		Where(predicate).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (post Post) {
+			row.UUIDField(&post.PostID, POST.POST_ID)
+			row.UUIDField(&post.Blog.BlogID, BLOG.BLOG_ID)
+			row.UUIDField(&post.Blog.UserID, BLOG.USER_ID)
+			post.Blog.Title = row.StringField(BLOG.TITLE)
+			post.Blog.Description = row.StringField(BLOG.DESCRIPTION)
+			post.Blog.CommentsEnabled = row.BoolField(BLOG.COMMENTS_ENABLED)
+			post.Blog.CommentsModerated = row.BoolField(BLOG.COMMENTS_MODERATED)
+			post.Blog.AnonymousComments = row.BoolField(BLOG.ANONYMOUS_COMMENTS)
+			post.Title = row.StringField(POST.TITLE)
+			post.Body = row.StringField(POST.BODY)
+			post.SourceNoteNumber = row.IntField(POST.SOURCE_NOTE_NUMBER)
+			post.EditedAt = row.TimeField(POST.UPDATED_AT)
+			post.Status = row.StringField(POST.STATUS)
+			post.PublishAt = row.TimeField(POST.PUBLISH_AT)
+			post.Slug = row.StringField(POST.SLUG)
+			return post
+		},
+	)
+	if err != nil {
+		return Post{}, err
+	}
+	tags, err := app.postTags(ctx, POST.POST_ID.EqUUID(post.PostID))
+	if err != nil {
+		return Post{}, err
+	}
+	post.Tags = tags[post.PostID]
+	return post, nil
+}
+
+// publishAtLayout is the format of the datetime-local input for the publish
+// time of a post. Publish times are entered in UTC.
+const publishAtLayout = "2006-01-02T15:04"
+
+// postForm is a post as it is submitted from the post editor.
+type postForm struct {
+	Title string
+	Body  string
+	// Slug is empty if no slug was entered.
+	Slug   string
+	Status string
+	// PublishAt is the zero time if no publish time was entered.
+	PublishAt time.Time
+	// Tags is nil if the form had no tags field.
+	Tags []string
+}
+
+// readPostForm reads the title, body, slug, status, publish time and tags of a
+// post from the submitted form. The slug is normalized with slugify and the
+// status defaults to published.
+func readPostForm(w http.ResponseWriter, r *http.Request) (form postForm, err error) {
+	// Leave room for the title and the form encoding.
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxPostSize)
+	err = r.ParseForm()
+	if err != nil {
+		return postForm{}, err
+	}
+	form.Title = strings.TrimSpace(r.PostForm.Get("title"))
+	form.Body = r.PostForm.Get("body")
+	form.Status = r.PostForm.Get("status")
+	if slug := strings.TrimSpace(r.PostForm.Get("slug")); slug != "" {
+		form.Slug = slugify(slug)
+		if form.Slug == "" {
+			return postForm{}, fmt.Errorf("invalid slug %q: a slug needs at least one letter or digit", slug)
+		}
+	}
+	if form.Title == "" {
+		return postForm{}, errors.New("post title is required")
+	}
+	if utf8.RuneCountInString(form.Title) > 255 {
+		return postForm{}, errors.New("post title is longer than 255 characters")
+	}
+	if len(form.Body) > maxPostSize {
+		return postForm{}, errPostTooLarge
+	}
+	switch form.Status {
+	case "":
+		form.Status = postPublished
+	case postDraft, postScheduled, postPublished:
+	default:
+		return postForm{}, fmt.Errorf("invalid post status %q", form.Status)
+	}
+	if publishAt := r.PostForm.Get("publish_at"); publishAt != "" {
+		// Browsers leave out the seconds of a datetime-local input
+		// unless they are set.
+		form.PublishAt, err = time.Parse(publishAtLayout, publishAt)
+		if err != nil {
+			form.PublishAt, err = time.Parse(publishAtLayout+":05", publishAt)
+			if err != nil {
+				return postForm{}, fmt.Errorf("invalid publish time %q", publishAt)
+			}
+		}
+	}
+	if form.Status == postScheduled && form.PublishAt.IsZero() {
+		return postForm{}, errors.New("publish time is required to schedule a post")
+	}
+	form.Tags, err = readTagsField(r)
+	if err != nil {
+		return postForm{}, err
+	}
+	return form, nil
+}
+
+// schedule settles the status and publish time of a submitted post. Drafts
+// have no publish time. Otherwise a post without a publish time keeps
+// publishedAt (its current publish time, if any) or is published now, and
+// the post is scheduled if its publish time is in the future or published if
+// it is not, whichever of the two was picked.
+func (form *postForm) schedule(publishedAt time.Time) {
+	if form.Status == postDraft {
+		form.PublishAt = time.Time{}
+		return
+	}
+	now := time.Now().UTC()
+	if form.PublishAt.IsZero() {
+		form.PublishAt = publishedAt
+		if form.PublishAt.IsZero() {
+			form.PublishAt = now
+		}
+	}
+	if form.PublishAt.After(now) {
+		form.Status = postScheduled
+	} else {
+		form.Status = postPublished
+	}
+}
+
+// postFormError responds to an error returned by readPostForm.
+func (app *App) postFormError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.Is(err, errPostTooLarge) {
+		app.Error(w, r, http.StatusRequestEntityTooLarge, errPostTooLarge)
+		return
+	}
+	app.Error(w, r, http.StatusBadRequest, err)
+}
+
+// servePost redirects the permanent link of a post, /post/<postID>/, to its
+// current URL.
+func (app *App) servePost(w http.ResponseWriter, r *http.Request, base32PostID string) {
+	if len(base32PostID) != ulid.EncodedSize {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	postID, err := ulid.Parse(base32PostID)
+	if err != nil {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	post, err := app.fetchPost(r.Context(), postID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	currentUserID, loggedIn := app.CurrentUserID(r)
+	if !post.Visible() && !(loggedIn && currentUserID == post.Blog.UserID) {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	http.Redirect(w, r, blogLinks(r, post.Blog.BlogIDString()).Post(post.Slug), http.StatusMovedPermanently)
+}
+
+// blogPost renders a post to anyone, at /blog/<blogID>/<slug>. The slugs that
+// a post used to have redirect to its current slug.
+func (app *App) blogPost(w http.ResponseWriter, r *http.Request, base32BlogID string, slug string) {
+	if len(base32BlogID) != ulid.EncodedSize {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	if lower := strings.ToLower(base32BlogID); lower != base32BlogID || strings.ToLower(slug) != slug {
+		http.Redirect(w, r, blogLinks(r, lower).Post(strings.ToLower(slug)), http.StatusMovedPermanently)
+		return
+	}
+	blogID, err := ulid.Parse(base32BlogID)
+	if err != nil {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	post, err := app.fetchPostBySlug(r.Context(), blogID, slug)
+	if errors.Is(err, sql.ErrNoRows) {
+		postID, err := app.formerPostSlug(r.Context(), blogID, slug)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				app.Error(w, r, http.StatusNotFound, nil)
+				return
+			}
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		app.servePost(w, r, strings.ToLower(postID.String()))
+		return
+	}
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	currentUserID, loggedIn := app.CurrentUserID(r)
+	isOwner := loggedIn && currentUserID == post.Blog.UserID
+	// Posts that aren't visible yet don't exist as far as the readers of
+	// the blog are concerned.
+	if !isOwner && !post.Visible() {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	links := blogLinks(r, post.Blog.BlogIDString())
+	var form *commentForm
+	// Readers can't log in on the domain of a blog, so blogs that need
+	// them to only show their comments there.
+	anonymousComments := app.anonymousComments(post.Blog)
+	if post.Blog.CommentsEnabled && post.Visible() && !(links.Domain && !anonymousComments) {
+		form = &commentForm{
+			PostID:          post.PostIDString(),
+			LoggedIn:        loggedIn,
+			LoginRequired:   !loggedIn && !anonymousComments,
+			HCaptchaSiteKey: app.HCaptchaSiteKey,
+		}
+		// A comment that was just submitted comes back with why it
+		// couldn't be added, or that it is waiting for approval.
+		err = app.Flash(w, r, form)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	var buf bytes.Buffer
+	err = app.renderPost(r.Context(), &buf, post, links, isOwner, form)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	setThemeHeaders(w)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// renderPost renders the page of a post with the theme of its blog, along with
+// its approved comments and the comment form (if form isn't nil). The owner
+// of the post also gets the links to edit it, and a banner if it is a draft or
+// scheduled.
+func (app *App) renderPost(ctx context.Context, w io.Writer, post Post, links siteLinks, isOwner bool, form *commentForm) error {
+	comments, err := app.postComments(ctx, post.PostID)
+	if err != nil {
+		return err
+	}
+	return app.renderTheme(ctx, w, "post", themeData{
+		Blog:        post.Blog,
+		Title:       post.Title + " - " + post.Blog.Title,
+		Post:        post,
+		Comments:    comments,
+		CommentForm: form,
+		IsOwner:     isOwner,
+		Links:       links,
+	})
+}
+
+type postEditorData struct {
+	Blog Blog
+	// PostID is empty for a new post.
+	PostID string
+	Title  string
+	Body   string
+	// Slug is empty for a new post.
+	Slug   string
+	Status string
+	// PublishAt is formatted with publishAtLayout, or empty for drafts.
+	PublishAt string
+	// Tags are the tags of the post separated by commas.
+	Tags string
+}
+
+// postEditor renders the form for writing a new post or editing an existing
+// one.
+func (app *App) postEditor(w http.ResponseWriter, r *http.Request, templateData postEditorData) {
+	tmpl, err := template.ParseFiles("html/edit_post.html")
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, templateData)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// errEmptyNote is returned when publishing a note that has nothing in it.
+var errEmptyNote = errors.New("note is empty")
+
+// notePublication is a blog that a note can be published to. PostID is the
+// post the note was published as on that blog, if it has been.
+type notePublication struct {
+	BlogID    string
+	BlogTitle string
+	PostID    string
+}
+
+// notePublications returns the blogs of a user, along with the posts that a
+// note of theirs has been published as on each blog.
+func (app *App) notePublications(ctx context.Context, userID ulid.ULID, noteNumber int) ([]notePublication, error) {
+	BLOG := sq.New[BLOG]("")
+	publications, err := sq.FetchAllContext(ctx, app.DB, sq.
+		From(BLOG).
+		Where(BLOG.USER_ID.EqUUID(userID)).
+		OrderBy(BLOG.BLOG_ID).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) notePublication {
+			var blogID ulid.ULID
+			row.UUIDField(&blogID, BLOG.BLOG_ID)
+			return notePublication{
+				BlogID:    strings.ToLower(blogID.String()),
+				BlogTitle: row.StringField(BLOG.TITLE),
+			}
+		},
+	)
+	if err != nil || len(publications) == 0 {
+		return publications, err
+	}
+	POST := sq.New[POST]("")
+	postIDs := make(map[string]string)
+	cursor, err := sq.FetchCursorContext(ctx, app.DB, sq.
+		From(POST).
+		Join(BLOG, BLOG.BLOG_ID.Eq(POST.BLOG_ID)).
+		Where(
+			BLOG.USER_ID.EqUUID(userID),
+			POST.SOURCE_NOTE_NUMBER.EqInt(noteNumber),
+		).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (result [2]ulid.ULID) {
+			row.UUIDField(&result[0], POST.BLOG_ID)
+			row.UUIDField(&result[1], POST.POST_ID)
+			return result
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	for cursor.Next() {
+		result, err := cursor.Result()
+		if err != nil {
+			return nil, err
+		}
+		postIDs[strings.ToLower(result[0].String())] = strings.ToLower(result[1].String())
+	}
+	err = cursor.Close()
+	if err != nil {
+		return nil, err
+	}
+	for i := range publications {
+		publications[i].PostID = postIDs[publications[i].BlogID]
+	}
+	return publications, nil
+}
+
+// publishNote publishes a note as a post on one of the user's blogs and
+// returns the ID of the post. If the note has already been published on that
+// blog, the existing post is updated with the current body of the note
+// instead, keeping its status, publish time and slug. Either way the post gets
+// the tags of the note. It returns sql.ErrNoRows if the user has no such note
+// or blog.
+func (app *App) publishNote(ctx context.Context, userID ulid.ULID, noteNumber int, blogID ulid.ULID) (ulid.ULID, error) {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	defer tx.Rollback()
+	NOTE := sq.New[NOTE]("")
+	note, err := sq.FetchOneContext(ctx, tx, sq.
+		From(NOTE).
+		Where(
+			NOTE.USER_ID.EqUUID(userID),
+			NOTE.NOTE_NUMBER.EqInt(noteNumber),
+		).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (result struct {
+			Body    string
+			Trashed bool
+		}) {
+			result.Body = row.StringField(NOTE.BODY)
+			result.Trashed = row.NullTimeField(NOTE.DELETED_AT).Valid
+			return result
+		},
+	)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	if note.Trashed {
+		return ulid.ULID{}, errNoteInTrash
+	}
+	title, body := postFromNote(note.Body)
+	if title == "" {
+		return ulid.ULID{}, errEmptyNote
+	}
+	BLOG := sq.New[BLOG]("")
+	exists, err := sq.FetchExistsContext(ctx, tx, sq.
+		SelectOne().
+		From(BLOG).
+		Where(
+			BLOG.BLOG_ID.EqUUID(blogID),
+			BLOG.USER_ID.EqUUID(userID),
+		).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	if !exists {
+		return ulid.ULID{}, sql.ErrNoRows
+	}
+	POST := sq.New[POST]("")
+	post, err := sq.FetchOneContext(ctx, tx, sq.
+		From(POST).
+		Where(
+			POST.BLOG_ID.EqUUID(blogID),
+			POST.SOURCE_NOTE_NUMBER.EqInt(noteNumber),
+		).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (post struct {
+			PostID ulid.ULID
+			Size   int64
+		}) {
+			row.UUIDField(&post.PostID, POST.POST_ID)
+			post.Size = row.Int64Field(octetLength(app.Dialect, POST.BODY))
+			return post
+		},
+	)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return ulid.ULID{}, err
+	}
+	exists = err == nil
+	postID := post.PostID
+	// Charge the user for the post, or for the change in its size.
+	err = app.updateUsage(ctx, tx, userID, Quota{NoteBytes: int64(len(body)) - post.Size})
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	if exists {
+		_, err = sq.ExecContext(ctx, tx, sq.
+			Update(POST).
+			Set(
+				POST.TITLE.SetString(title),
+				POST.BODY.SetString(body),
+				POST.UPDATED_AT.SetTime(time.Now().UTC()),
+			).
+			Where(POST.POST_ID.EqUUID(postID)).
+			SetDialect(app.Dialect),
+		)
+	} else {
+		postID = ulid.Make()
+		var slug string
+		slug, err = app.uniquePostSlug(ctx, tx, blogID, postID, slugify(title))
+		if err != nil {
+			return ulid.ULID{}, err
+		}
+		err = app.claimPostSlug(ctx, tx, blogID, postID, "", slug)
+		if err != nil {
+			return ulid.ULID{}, err
+		}
+		_, err = sq.ExecContext(ctx, tx, sq.
+			InsertInto(POST).
+			ColumnValues(func(col *sq.Column) {
+				col.SetUUID(POST.POST_ID, postID)
+				col.SetUUID(POST.BLOG_ID, blogID)
+				col.SetString(POST.TITLE, title)
+				col.SetString(POST.BODY, body)
+				col.SetInt(POST.SOURCE_NOTE_NUMBER, noteNumber)
+				col.SetString(POST.STATUS, postPublished)
+				col.SetTime(POST.PUBLISH_AT, time.Now().UTC())
+				col.SetString(POST.SLUG, slug)
+			}).
+			SetDialect(app.Dialect),
+		)
+	}
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	tags, err := app.noteTagNames(ctx, tx, userID, noteNumber)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	err = app.setPostTags(ctx, tx, userID, postID, tags)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	return postID, nil
+}
+
+// postFromNote splits a note body into the title and body of a post. The
+// first non-blank line of the note is the title and the rest of the note is
+// the body.
+func postFromNote(note string) (title, body string) {
+	note = strings.TrimLeft(note, " \t\r\n")
+	title, body, _ = strings.Cut(note, "\n")
+	title = strings.TrimSpace(title)
+	if utf8.RuneCountInString(title) > 255 {
+		title = string([]rune(title)[:255])
+	}
+	return title, strings.TrimLeft(body, "\r\n")
+}
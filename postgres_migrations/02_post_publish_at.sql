@@ -0,0 +1,4 @@
+-- Posts written before they could be scheduled were published when they were
+-- created, which is the timestamp in the first 6 bytes of their ULID.
+UPDATE post SET publish_at = to_timestamp(('x' || lpad(substr(replace(post_id::text, '-', ''), 1, 12), 16, '0'))::bit(64)::bigint / 1000.0)
+WHERE status = 'published' AND publish_at IS NULL;
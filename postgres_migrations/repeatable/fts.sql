@@ -1,4 +1,7 @@
 DROP TRIGGER IF EXISTS note_before_insert_update_trigger ON note;
 
-CREATE TRIGGER note_before_insert_update_trigger BEFORE INSERT OR UPDATE ON note
+-- Only changes to the body need to be reindexed, moving a note in or out of
+-- the trash (which updates deleted_at) does not. Notes in the trash stay
+-- indexed, search queries filter them out instead.
+CREATE TRIGGER note_before_insert_update_trigger BEFORE INSERT OR UPDATE OF body ON note
 FOR EACH ROW EXECUTE PROCEDURE tsvector_update_trigger(fts, 'pg_catalog.english', body);
@@ -0,0 +1,155 @@
+package notebrew
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// Quota is how much a user may store. A zero limit means unlimited.
+type Quota struct {
+	// ImageBytes is the total size of the user's images.
+	ImageBytes int64
+
+	// Notes is the number of the user's notes, including those in the
+	// trash.
+	Notes int64
+
+	// NoteBytes is the total size of the bodies of the user's notes
+	// (including those in the trash), of their revisions and of the user's
+	// posts.
+	NoteBytes int64
+}
+
+// maxNoteSize is the maximum size of a note body in bytes, matching the
+// length of NOTE.BODY.
+const maxNoteSize = 65536
+
+// errNoteTooLarge is returned when a note body is larger than maxNoteSize.
+var errNoteTooLarge = fmt.Errorf("note is larger than %s", formatBytes(maxNoteSize))
+
+// quotaExceededError is returned when storing something would take a user
+// over their quota.
+type quotaExceededError struct {
+	// What is what ran out, for the error message.
+	What  string
+	Limit string
+}
+
+func (e *quotaExceededError) Error() string {
+	return "you have reached your quota of " + e.Limit + " " + e.What
+}
+
+// userQuota returns the storage used by a user and the user's quota. A user's
+// quota is app.DefaultQuota unless it is overridden in the QUOTA_* columns of
+// their row in USERS. If lock is true, the user's row is locked until the end
+// of the transaction.
+func (app *App) userQuota(ctx context.Context, db sq.DB, userID ulid.ULID, lock bool) (usage Quota, quota Quota, err error) {
+	USERS := sq.New[USERS]("")
+	query := sq.
+		From(USERS).
+		Where(USERS.USER_ID.EqUUID(userID)).
+		SetDialect(app.Dialect)
+	if lock && app.Dialect != sq.DialectSQLite {
+		query.LockClause = "FOR UPDATE"
+	}
+	type result struct {
+		Usage      Quota
+		ImageBytes sql.NullInt64
+		Notes      sql.NullInt64
+		NoteBytes  sql.NullInt64
+	}
+	row, err := sq.FetchOneContext(ctx, db, query, func(row *sq.Row) (result result) {
+		result.Usage.ImageBytes = row.Int64Field(USERS.IMAGE_BYTES)
+		result.Usage.Notes = row.Int64Field(USERS.NOTE_COUNT)
+		result.Usage.NoteBytes = row.Int64Field(USERS.NOTE_BYTES)
+		result.ImageBytes = row.NullInt64Field(USERS.QUOTA_IMAGE_BYTES)
+		result.Notes = row.NullInt64Field(USERS.QUOTA_NOTES)
+		result.NoteBytes = row.NullInt64Field(USERS.QUOTA_NOTE_BYTES)
+		return result
+	})
+	if err != nil {
+		return Quota{}, Quota{}, err
+	}
+	quota = app.DefaultQuota
+	if row.ImageBytes.Valid {
+		quota.ImageBytes = row.ImageBytes.Int64
+	}
+	if row.Notes.Valid {
+		quota.Notes = row.Notes.Int64
+	}
+	if row.NoteBytes.Valid {
+		quota.NoteBytes = row.NoteBytes.Int64
+	}
+	return row.Usage, quota, nil
+}
+
+// updateUsage adds delta to the storage used by a user inside a transaction.
+// It returns a *quotaExceededError if any of the usages that delta increases
+// would go over the user's quota. Usages that stay the same or go down are
+// never refused, so that users over their quota (because it was lowered) can
+// still delete things.
+func (app *App) updateUsage(ctx context.Context, tx *sql.Tx, userID ulid.ULID, delta Quota) error {
+	usage, quota, err := app.userQuota(ctx, tx, userID, true)
+	if err != nil {
+		return err
+	}
+	if delta.ImageBytes > 0 && quota.ImageBytes > 0 && usage.ImageBytes+delta.ImageBytes > quota.ImageBytes {
+		return &quotaExceededError{What: "of images", Limit: formatBytes(quota.ImageBytes)}
+	}
+	if delta.Notes > 0 && quota.Notes > 0 && usage.Notes+delta.Notes > quota.Notes {
+		return &quotaExceededError{What: "notes", Limit: strconv.FormatInt(quota.Notes, 10)}
+	}
+	if delta.NoteBytes > 0 && quota.NoteBytes > 0 && usage.NoteBytes+delta.NoteBytes > quota.NoteBytes {
+		return &quotaExceededError{What: "of notes", Limit: formatBytes(quota.NoteBytes)}
+	}
+	if delta == (Quota{}) {
+		return nil
+	}
+	USERS := sq.New[USERS]("")
+	_, err = sq.ExecContext(ctx, tx, sq.
+		Update(USERS).
+		Set(
+			USERS.IMAGE_BYTES.Setf("{} + {}", USERS.IMAGE_BYTES, delta.ImageBytes),
+			USERS.NOTE_COUNT.Setf("{} + {}", USERS.NOTE_COUNT, delta.Notes),
+			USERS.NOTE_BYTES.Setf("{} + {}", USERS.NOTE_BYTES, delta.NoteBytes),
+		).
+		Where(USERS.USER_ID.EqUUID(userID)).
+		SetDialect(app.Dialect),
+	)
+	return err
+}
+
+// isQuotaError reports whether err is a *quotaExceededError.
+func isQuotaError(err error) bool {
+	var quotaErr *quotaExceededError
+	return errors.As(err, &quotaErr)
+}
+
+// octetLength returns an expression for the length of a text field in bytes.
+func octetLength(dialect string, field sq.Field) sq.Expression {
+	// SQLite's LENGTH counts characters, unless it is given a blob.
+	if dialect == sq.DialectSQLite {
+		return sq.Expr("LENGTH(CAST({} AS BLOB))", field)
+	}
+	return sq.Expr("OCTET_LENGTH({})", field)
+}
+
+// formatBytes formats a number of bytes for humans, e.g. 1.5 MB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + "KMGTPE"[exp:exp+1] + "B"
+}
@@ -2,11 +2,9 @@ package notebrew
 
 import (
 	"bytes"
-	"encoding/json"
 	"html/template"
 	"log"
 	"net/http"
-	"net/url"
 	"strings"
 
 	"github.com/bokwoon95/sq"
@@ -15,29 +13,11 @@ import (
 )
 
 func (app *App) Register(w http.ResponseWriter, r *http.Request) {
-	const HCaptchaSiteKey = "10000000-ffff-ffff-ffff-000000000001"
 	type TemplateData struct {
 		Email           string
 		HCaptchaSiteKey string
 		ErrMsg          string
 	}
-	type HCaptchaVerificationResult struct {
-		// From https://docs.hcaptcha.com/
-		// {
-		//    "success": true|false,     // is the passcode valid, and does it meet security criteria you specified, e.g. sitekey?
-		//    "challenge_ts": timestamp, // timestamp of the challenge (ISO format yyyy-MM-dd'T'HH:mm:ssZZ)
-		//    "hostname": string,        // the hostname of the site where the challenge was solved
-		//    "credit": true|false,      // optional: whether the response will be credited
-		//    "error-codes": [...]       // optional: any error codes
-		//    "score": float,            // ENTERPRISE feature: a score denoting malicious activity.
-		//    "score_reason": [...]      // ENTERPRISE feature: reason(s) for score.
-		// }
-		Success     bool   `json:"success"`
-		ChallengeTs string `json:"challenge_ts"`
-		Hostname    string `json:"hostname"`
-		Credit      bool   `json:"credit"`
-		ErrorCodes  []any  `json:"error-codes"`
-	}
 
 	if r.Method != "GET" && r.Method != "POST" {
 		app.Error(w, r, http.StatusMethodNotAllowed, nil)
@@ -58,7 +38,7 @@ func (app *App) Register(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Println(err)
 		}
-		templateData.HCaptchaSiteKey = HCaptchaSiteKey
+		templateData.HCaptchaSiteKey = app.HCaptchaSiteKey
 		tmpl, err := template.ParseFiles("html/register.html")
 		if err != nil {
 			app.Error(w, r, http.StatusInternalServerError, err)
@@ -89,23 +69,12 @@ func (app *App) Register(w http.ResponseWriter, r *http.Request) {
 	password := r.PostForm.Get("password")
 
 	// Check with hCaptcha if the captcha response is valid.
-	resp, err := http.PostForm("https://hcaptcha.com/siteverify", url.Values{
-		"secret":   []string{"0x0000000000000000000000000000000000000000"},
-		"response": []string{hCaptchaResponse},
-		"sitekey":  []string{HCaptchaSiteKey},
-	})
-	if err != nil {
-		app.Error(w, r, http.StatusInternalServerError, err)
-		return
-	}
-	defer resp.Body.Close()
-	var verificationResult HCaptchaVerificationResult
-	err = json.NewDecoder(resp.Body).Decode(&verificationResult)
+	success, err := app.verifyHCaptcha(r.Context(), hCaptchaResponse)
 	if err != nil {
 		app.Error(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	if !verificationResult.Success {
+	if !success {
 		templateData.ErrMsg = "failed captcha"
 		app.Redirect(w, r, r.URL.Path, templateData)
 		return
@@ -0,0 +1,113 @@
+package notebrew
+
+import (
+	"image"
+	"image/draw"
+)
+
+// resizeImage scales src down to the given width, preserving its aspect
+// ratio. Every destination pixel is the average of the source pixels it
+// covers (a box filter), which is what you want when shrinking photos. src
+// must be wider than width.
+func resizeImage(src image.Image, width int) *image.RGBA {
+	srcBounds := src.Bounds()
+	srcWidth, srcHeight := srcBounds.Dx(), srcBounds.Dy()
+	height := (srcHeight*width + srcWidth/2) / srcWidth
+	if height < 1 {
+		height = 1
+	}
+
+	// Work on premultiplied RGBA so that averaging doesn't bleed the color
+	// of transparent pixels into their neighbours.
+	rgba, ok := src.(*image.RGBA)
+	if !ok || rgba.Rect.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, srcWidth, srcHeight))
+		draw.Draw(rgba, rgba.Rect, src, srcBounds.Min, draw.Src)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xSpans := boxSpans(srcWidth, width)
+	ySpans := boxSpans(srcHeight, height)
+	// row accumulates the weighted sum of the source rows that make up one
+	// destination row, so that only one row of intermediate values is held in
+	// memory at a time.
+	row := make([]float32, srcWidth*4)
+	for y, ySpan := range ySpans {
+		for i := range row {
+			row[i] = 0
+		}
+		for sy, weight := range ySpan.weights {
+			srcRow := rgba.Pix[(ySpan.start+sy)*rgba.Stride : (ySpan.start+sy)*rgba.Stride+srcWidth*4]
+			for i, value := range srcRow {
+				row[i] += float32(value) * weight
+			}
+		}
+		dstRow := dst.Pix[y*dst.Stride : y*dst.Stride+width*4]
+		for x, xSpan := range xSpans {
+			var r, g, b, a float32
+			for sx, weight := range xSpan.weights {
+				i := (xSpan.start + sx) * 4
+				r += row[i] * weight
+				g += row[i+1] * weight
+				b += row[i+2] * weight
+				a += row[i+3] * weight
+			}
+			dstRow[x*4] = clampUint8(r)
+			dstRow[x*4+1] = clampUint8(g)
+			dstRow[x*4+2] = clampUint8(b)
+			dstRow[x*4+3] = clampUint8(a)
+		}
+	}
+	return dst
+}
+
+// boxSpan is the range of source pixels covered by one destination pixel,
+// and how much each of them contributes to it.
+type boxSpan struct {
+	start   int
+	weights []float32
+}
+
+// boxSpans maps each of the dstSize destination pixels to the srcSize source
+// pixels it covers. The weights of each span add up to 1.
+func boxSpans(srcSize, dstSize int) []boxSpan {
+	spans := make([]boxSpan, dstSize)
+	scale := float64(srcSize) / float64(dstSize)
+	for i := range spans {
+		lo, hi := float64(i)*scale, float64(i+1)*scale
+		start, end := int(lo), int(hi+0.999999)
+		if end > srcSize {
+			end = srcSize
+		}
+		if end <= start {
+			end = start + 1
+		}
+		weights := make([]float32, end-start)
+		for j := range weights {
+			// The overlap between source pixel [start+j, start+j+1) and
+			// the destination pixel's span [lo, hi).
+			left, right := float64(start+j), float64(start+j+1)
+			if left < lo {
+				left = lo
+			}
+			if right > hi {
+				right = hi
+			}
+			if right > left {
+				weights[j] = float32((right - left) / scale)
+			}
+		}
+		spans[i] = boxSpan{start: start, weights: weights}
+	}
+	return spans
+}
+
+func clampUint8(f float32) uint8 {
+	if f <= 0 {
+		return 0
+	}
+	if f >= 255 {
+		return 255
+	}
+	return uint8(f + 0.5)
+}
@@ -0,0 +1,150 @@
+package notebrew
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestResizeImage(t *testing.T) {
+	type TestTable struct {
+		description string
+		src         image.Image
+		width       int
+		wantWidth   int
+		wantHeight  int
+		// wantPixels are the expected RGBA values of the destination, row by
+		// row. They are only checked if not nil.
+		wantPixels []uint8
+	}
+
+	// A 4x2 image whose left half is black and right half is white.
+	halves := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			if x >= 2 {
+				halves.Set(x, y, color.White)
+			} else {
+				halves.Set(x, y, color.Black)
+			}
+		}
+	}
+	// The same image, but with its bounds not starting at the origin.
+	offset := halves.SubImage(image.Rect(1, 0, 4, 2))
+	// A gray image of a type other than *image.RGBA.
+	gray := image.NewGray(image.Rect(0, 0, 9, 3))
+	for i := range gray.Pix {
+		gray.Pix[i] = 100
+	}
+
+	tests := []TestTable{{
+		description: "halved",
+		src:         halves,
+		width:       2,
+		wantWidth:   2,
+		wantHeight:  1,
+		wantPixels:  []uint8{0, 0, 0, 255, 255, 255, 255, 255},
+	}, {
+		description: "averaged into one pixel",
+		src:         halves,
+		width:       1,
+		wantWidth:   1,
+		wantHeight:  1,
+		wantPixels:  []uint8{128, 128, 128, 255},
+	}, {
+		description: "bounds not at the origin",
+		src:         offset,
+		width:       1,
+		wantWidth:   1,
+		wantHeight:  1,
+		wantPixels:  []uint8{170, 170, 170, 255},
+	}, {
+		description: "uniform image stays uniform",
+		src:         gray,
+		width:       3,
+		wantWidth:   3,
+		wantHeight:  1,
+		wantPixels:  []uint8{100, 100, 100, 255, 100, 100, 100, 255, 100, 100, 100, 255},
+	}, {
+		description: "height rounded to nearest",
+		src:         image.NewRGBA(image.Rect(0, 0, 100, 75)),
+		width:       10,
+		wantWidth:   10,
+		wantHeight:  8,
+	}, {
+		description: "height at least 1",
+		src:         image.NewRGBA(image.Rect(0, 0, 1000, 1)),
+		width:       10,
+		wantWidth:   10,
+		wantHeight:  1,
+	}}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.description, func(t *testing.T) {
+			t.Parallel()
+			dst := resizeImage(tt.src, tt.width)
+			if dst.Rect.Dx() != tt.wantWidth || dst.Rect.Dy() != tt.wantHeight {
+				t.Fatalf("got %dx%d, want %dx%d", dst.Rect.Dx(), dst.Rect.Dy(), tt.wantWidth, tt.wantHeight)
+			}
+			if tt.wantPixels == nil {
+				return
+			}
+			var gotPixels []uint8
+			for y := 0; y < dst.Rect.Dy(); y++ {
+				gotPixels = append(gotPixels, dst.Pix[y*dst.Stride:y*dst.Stride+dst.Rect.Dx()*4]...)
+			}
+			if len(gotPixels) != len(tt.wantPixels) {
+				t.Fatalf("got %v, want %v", gotPixels, tt.wantPixels)
+			}
+			for i := range gotPixels {
+				// Allow for rounding in the float32 sums.
+				if diff := int(gotPixels[i]) - int(tt.wantPixels[i]); diff < -1 || diff > 1 {
+					t.Fatalf("got %v, want %v", gotPixels, tt.wantPixels)
+				}
+			}
+		})
+	}
+}
+
+func TestBoxSpans(t *testing.T) {
+	type TestTable struct {
+		srcSize, dstSize int
+	}
+
+	tests := []TestTable{
+		{srcSize: 4, dstSize: 2},
+		{srcSize: 10, dstSize: 3},
+		{srcSize: 7, dstSize: 7},
+		{srcSize: 1000, dstSize: 333},
+		{srcSize: 5, dstSize: 1},
+	}
+
+	for _, tt := range tests {
+		spans := boxSpans(tt.srcSize, tt.dstSize)
+		if len(spans) != tt.dstSize {
+			t.Fatalf("boxSpans(%d, %d): got %d spans, want %d", tt.srcSize, tt.dstSize, len(spans), tt.dstSize)
+		}
+		// Every source pixel is covered exactly once in total.
+		coverage := make([]float64, tt.srcSize)
+		for i, span := range spans {
+			var sum float64
+			for j, weight := range span.weights {
+				if span.start+j >= tt.srcSize {
+					t.Fatalf("boxSpans(%d, %d): span %d goes past the source", tt.srcSize, tt.dstSize, i)
+				}
+				sum += float64(weight)
+				coverage[span.start+j] += float64(weight) * float64(tt.srcSize) / float64(tt.dstSize)
+			}
+			if math.Abs(sum-1) > 1e-5 {
+				t.Errorf("boxSpans(%d, %d): weights of span %d add up to %v, want 1", tt.srcSize, tt.dstSize, i, sum)
+			}
+		}
+		for i, c := range coverage {
+			if math.Abs(c-1) > 1e-4 {
+				t.Errorf("boxSpans(%d, %d): source pixel %d is covered %v times, want 1", tt.srcSize, tt.dstSize, i, c)
+			}
+		}
+	}
+}
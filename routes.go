@@ -1,6 +1,9 @@
 package notebrew
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"net/http"
 	"strings"
 )
@@ -19,8 +22,28 @@ func (app *App) Handler() http.Handler {
 	mux.HandleFunc("/n/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/note/"+strings.TrimPrefix(r.URL.Path, "/n/"), http.StatusFound)
 	})
+	mux.HandleFunc("/image/", app.Image)
+	mux.HandleFunc("/blog/", app.Blog)
+	mux.HandleFunc("/post/", app.Post)
+	mux.HandleFunc("/comment/", app.Comment)
+	mux.HandleFunc("/sitemap.xml", app.Sitemap)
+	mux.HandleFunc("/robots.txt", app.Robots)
 	mux.HandleFunc("/static/", app.Static)
 	mux.HandleFunc("/esmodules/", app.Static)
 	mux.HandleFunc("/", app.Root)
-	return mux
+	// Requests on the domain of a blog (see BLOG_DOMAIN) are served the
+	// pages of the blog, while every other host is served the app.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blogID, err := app.hostBlog(r.Context(), r.Host)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				app.Error(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			mux.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), blogDomainKey{}, blogID))
+		app.serveBlogDomain(w, r, blogID)
+	})
 }
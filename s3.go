@@ -0,0 +1,369 @@
+package notebrew
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3FS is an FS that stores files as objects in a bucket of an S3-compatible
+// object storage service (Amazon S3, MinIO, Cloudflare R2, etc). Requests are
+// signed with AWS Signature Version 4 and use path-style URLs
+// (<endpoint>/<bucket>/<name>), which every S3-compatible service supports.
+type S3FS struct {
+	// Endpoint is the base URL of the service, e.g.
+	// https://s3.us-east-1.amazonaws.com or http://localhost:9000.
+	Endpoint string
+
+	Bucket          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Client is the HTTP client used to make requests. If nil,
+	// s3DefaultClient is used.
+	Client *http.Client
+}
+
+// s3DefaultClient is the HTTP client used by an S3FS without a Client. Unlike
+// http.DefaultClient it has a timeout, so that a stalled endpoint fails the
+// request instead of hanging it forever.
+var s3DefaultClient = &http.Client{Timeout: time.Minute}
+
+// ParseS3URL parses an S3 URL of the form
+//
+//	s3://<access_key_id>:<secret_access_key>@<host>/<bucket>?region=<region>
+//
+// into an S3FS. The endpoint uses https unless the insecure query parameter
+// is present. The region defaults to us-east-1.
+func ParseS3URL(rawURL string) (*S3FS, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" {
+		return nil, fmt.Errorf("%s: not an s3:// URL", rawURL)
+	}
+	bucket := strings.Trim(u.Path, "/")
+	if u.Host == "" || bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("%s: URL must be of the form s3://<host>/<bucket>", u.Redacted())
+	}
+	query := u.Query()
+	s3FS := &S3FS{
+		Endpoint: "https://" + u.Host,
+		Bucket:   bucket,
+		Region:   query.Get("region"),
+	}
+	if query.Has("insecure") {
+		s3FS.Endpoint = "http://" + u.Host
+	}
+	if s3FS.Region == "" {
+		s3FS.Region = "us-east-1"
+	}
+	if u.User != nil {
+		s3FS.AccessKeyID = u.User.Username()
+		s3FS.SecretAccessKey, _ = u.User.Password()
+	}
+	return s3FS, nil
+}
+
+func (s3FS *S3FS) Open(name string) (fs.File, error) {
+	resp, err := s3FS.do("GET", name, nil, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3File{
+		ReadCloser: resp.Body,
+		info: s3FileInfo{
+			name:    name,
+			size:    size,
+			modTime: modTime,
+		},
+	}, nil
+}
+
+func (s3FS *S3FS) OpenWriter(name string) (io.WriteCloser, error) {
+	return &s3Writer{s3FS: s3FS, name: name}, nil
+}
+
+// s3Writer buffers everything written to it and uploads it as a single
+// object when it is closed. The whole object is needed up front anyway to
+// compute its SHA-256 for the request signature.
+type s3Writer struct {
+	s3FS *S3FS
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	resp, err := w.s3FS.do("PUT", w.name, nil, w.buf.Bytes())
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: w.name, Err: err}
+	}
+	return resp.Body.Close()
+}
+
+func (s3FS *S3FS) Stat(name string) (fs.FileInfo, error) {
+	resp, err := s3FS.do("HEAD", name, nil, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	defer resp.Body.Close()
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return s3FileInfo{
+		name:    name,
+		size:    size,
+		modTime: modTime,
+	}, nil
+}
+
+// Remove removes the named object. Unlike os.Remove, removing an object that
+// does not exist is not an error because S3 does not report it.
+func (s3FS *S3FS) Remove(name string) error {
+	resp, err := s3FS.do("DELETE", name, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return resp.Body.Close()
+}
+
+// ReadDir lists every object in the bucket, following ListObjectsV2's
+// continuation tokens until the listing is complete.
+func (s3FS *S3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	var entries []fs.DirEntry
+	query := url.Values{"list-type": []string{"2"}}
+	for {
+		resp, err := s3FS.do("GET", "", query, nil)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		for _, object := range result.Contents {
+			entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{
+				name:    object.Key,
+				size:    object.Size,
+				modTime: object.LastModified,
+			}))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	// Objects are listed in UTF-8 binary order, which for our names is
+	// already sorted by name.
+	return entries, nil
+}
+
+type s3File struct {
+	io.ReadCloser
+	info s3FileInfo
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (info s3FileInfo) Name() string       { return info.name }
+func (info s3FileInfo) Size() int64        { return info.size }
+func (info s3FileInfo) Mode() fs.FileMode  { return 0644 }
+func (info s3FileInfo) ModTime() time.Time { return info.modTime }
+func (info s3FileInfo) IsDir() bool        { return false }
+func (info s3FileInfo) Sys() any           { return nil }
+
+// s3Error is the error document returned by S3 when a request fails.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return "s3: " + strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode)
+	}
+	return "s3: " + e.Code + ": " + e.Message
+}
+
+// Is makes errors.Is(err, fs.ErrNotExist) report whether the object did not
+// exist.
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey")
+}
+
+// do makes a signed request for the object with the given name (or for the
+// bucket itself if name is empty). If the response has a non-2xx status, its
+// body is closed and an *s3Error is returned.
+func (s3FS *S3FS) do(method string, name string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s3FS.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s3FS.Bucket
+	if name != "" {
+		u.Path += "/" + name
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body = nil
+		req.ContentLength = 0
+	}
+	s3FS.sign(req, body, time.Now())
+	client := s3FS.Client
+	if client == nil {
+		client = s3DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		s3Err := &s3Error{StatusCode: resp.StatusCode}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		_ = xml.Unmarshal(b, s3Err)
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+// sign signs req with AWS Signature Version 4, covering the host and every
+// header already set on the request. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html.
+func (s3FS *S3FS) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.EscapedPath(), false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s3FS.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s3FS.SecretAccessKey), date)
+	key = hmacSHA256(key, s3FS.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s3FS.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery returns the query string sorted and encoded the way
+// Signature Version 4 expects.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3URIEncode percent-encodes every byte of s except the unreserved
+// characters (and '/' unless encodeSlash is true). Already escaped paths are
+// unescaped first so that nothing is encoded twice.
+func s3URIEncode(s string, encodeSlash bool) string {
+	if !encodeSlash {
+		if unescaped, err := url.PathUnescape(s); err == nil {
+			s = unescaped
+		}
+	}
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&15])
+	}
+	return b.String()
+}
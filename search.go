@@ -0,0 +1,188 @@
+package notebrew
+
+import (
+	"context"
+	"html/template"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// searchResultsLimit is the maximum number of results returned by a note
+// search.
+const searchResultsLimit = 50
+
+// The full text search functions are told to surround matched terms with
+// these markers. They are swapped for <mark> tags once the rest of the snippet
+// has been HTML-escaped.
+const (
+	highlightStart = "\x02"
+	highlightEnd   = "\x03"
+)
+
+type noteSearchResult struct {
+	NoteNumber int
+	Snippet    template.HTML
+}
+
+// searchNotes runs a full text search over the user's notes (excluding those
+// in the trash), returning the matching notes ordered by relevance. If tag is
+// not empty, only the notes with that tag are searched. Each dialect queries
+// the full text index maintained by its repeatable/fts.sql migration.
+func (app *App) searchNotes(ctx context.Context, userID ulid.ULID, query string, tag string) ([]noteSearchResult, error) {
+	NOTE := sq.New[NOTE]("")
+	NOTE_FTS := sq.New[NOTE_FTS]("")
+	predicates := []sq.Predicate{
+		NOTE.USER_ID.EqUUID(userID),
+		NOTE.DELETED_AT.IsNull(),
+	}
+	if tag != "" {
+		predicates = append(predicates, noteTagged(NOTE, tag))
+	}
+	switch app.Dialect {
+	case sq.DialectSQLite:
+		matchQuery := sqliteMatchQuery(query)
+		if matchQuery == "" {
+			return nil, nil
+		}
+		return sq.FetchAllContext(ctx, app.DB, sq.
+			From(NOTE_FTS).
+			Join(NOTE, sq.Expr("note.rowid = note_fts.rowid")).
+			Where(append(predicates, sq.Expr("{} MATCH {}", NOTE_FTS.NOTE_FTS, matchQuery))...).
+			OrderBy(NOTE_FTS.RANK).
+			Limit(searchResultsLimit).
+			SetDialect(app.Dialect),
+			func(row *sq.Row) noteSearchResult {
+				return noteSearchResult{
+					NoteNumber: row.IntField(NOTE.NOTE_NUMBER),
+					Snippet:    highlight(row.String("snippet(note_fts, 0, {}, {}, '…', 32)", highlightStart, highlightEnd)),
+				}
+			},
+		)
+	case sq.DialectPostgres:
+		tsquery := sq.Expr("websearch_to_tsquery('pg_catalog.english', {})", query)
+		return sq.FetchAllContext(ctx, app.DB, sq.
+			From(NOTE).
+			Where(append(predicates, sq.Expr("{} @@ {}", NOTE.FTS, tsquery))...).
+			OrderBy(sq.Expr("ts_rank({}, {}) DESC", NOTE.FTS, tsquery)).
+			Limit(searchResultsLimit).
+			SetDialect(app.Dialect),
+			func(row *sq.Row) noteSearchResult {
+				return noteSearchResult{
+					NoteNumber: row.IntField(NOTE.NOTE_NUMBER),
+					Snippet: highlight(row.String("ts_headline('pg_catalog.english', {}, {}, {})",
+						NOTE.BODY,
+						tsquery,
+						"StartSel="+highlightStart+", StopSel="+highlightEnd+", MaxWords=40, MinWords=20, MaxFragments=2, FragmentDelimiter=\" … \"",
+					)),
+				}
+			},
+		)
+	case sq.DialectMySQL:
+		match := sq.Expr("MATCH ({}) AGAINST ({} IN NATURAL LANGUAGE MODE)", NOTE_FTS.BODY, query)
+		results, err := sq.FetchAllContext(ctx, app.DB, sq.
+			From(NOTE_FTS).
+			Join(NOTE, sq.Expr("{} = {} AND {} = {}",
+				NOTE.USER_ID, NOTE_FTS.USER_ID,
+				NOTE.NOTE_NUMBER, NOTE_FTS.NOTE_NUMBER,
+			)).
+			Where(append(predicates, match)...).
+			OrderBy(sq.Expr("{} DESC", match)).
+			Limit(searchResultsLimit).
+			SetDialect(app.Dialect),
+			func(row *sq.Row) (result struct {
+				NoteNumber int
+				Body       string
+			}) {
+				result.NoteNumber = row.IntField(NOTE_FTS.NOTE_NUMBER)
+				result.Body = row.StringField(NOTE_FTS.BODY)
+				return result
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		// MySQL has no equivalent of snippet() or ts_headline(), so we cut
+		// out the snippets ourselves.
+		terms := strings.Fields(query)
+		searchResults := make([]noteSearchResult, len(results))
+		for i, result := range results {
+			searchResults[i] = noteSearchResult{
+				NoteNumber: result.NoteNumber,
+				Snippet:    highlight(snippet(result.Body, terms)),
+			}
+		}
+		return searchResults, nil
+	}
+	return nil, nil
+}
+
+// sqliteMatchQuery converts a user-provided search query into an FTS5 MATCH
+// query. Every word is quoted so that characters which have a special meaning
+// in the FTS5 query syntax are matched literally instead of causing a syntax
+// error.
+func sqliteMatchQuery(query string) string {
+	words := strings.Fields(query)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// snippetLength is the approximate number of characters in a snippet
+// generated by snippet().
+const snippetLength = 200
+
+// snippet returns an excerpt of body around the first occurrence of any of
+// the terms, with every occurrence of the terms in the excerpt surrounded by
+// highlightStart and highlightEnd.
+func snippet(body string, terms []string) string {
+	var patterns []string
+	for _, term := range terms {
+		patterns = append(patterns, regexp.QuoteMeta(term))
+	}
+	if len(patterns) == 0 {
+		return truncate(body, snippetLength)
+	}
+	re := regexp.MustCompile(`(?i)` + strings.Join(patterns, "|"))
+	loc := re.FindStringIndex(body)
+	if loc == nil {
+		return truncate(body, snippetLength)
+	}
+	// Start the excerpt a little before the first match, on a rune boundary.
+	start := loc[0] - snippetLength/4
+	if start < 0 {
+		start = 0
+	}
+	for start > 0 && !utf8.RuneStart(body[start]) {
+		start--
+	}
+	excerpt := truncate(body[start:], snippetLength)
+	excerpt = re.ReplaceAllString(excerpt, highlightStart+"$0"+highlightEnd)
+	if start > 0 {
+		excerpt = "…" + excerpt
+	}
+	return excerpt
+}
+
+// truncate truncates s to n characters, appending an ellipsis if anything
+// was cut off.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:n]) + "…"
+}
+
+// highlight HTML-escapes s and then replaces the highlightStart and
+// highlightEnd markers in it with <mark> tags.
+func highlight(s string) template.HTML {
+	s = template.HTMLEscapeString(s)
+	s = strings.ReplaceAll(s, highlightStart, "<mark>")
+	s = strings.ReplaceAll(s, highlightEnd, "</mark>")
+	return template.HTML(s)
+}
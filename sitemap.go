@@ -0,0 +1,396 @@
+package notebrew
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// sitemapSize is the maximum number of URLs in a sitemap, set by the sitemap
+// protocol. Past it, /sitemap.xml is a sitemap index of the sitemaps
+// /sitemap.xml?page=1, /sitemap.xml?page=2 and so on, each with up to
+// sitemapSize URLs.
+const sitemapSize = 50000
+
+type sitemapURLSet struct {
+	XMLName xml.Name       `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapEntry `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name       `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapEntry `xml:"sitemap"`
+}
+
+// sitemapEntry is a URL in a sitemap, or a sitemap in a sitemap index.
+type sitemapEntry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemapURL is a page of a blog listed in the sitemap, along with when it
+// last changed.
+type sitemapURL struct {
+	Loc     string
+	LastMod time.Time
+}
+
+// Sitemap serves /sitemap.xml, which lists the pages of every blog for search
+// engines: the index page of each blog, its visible posts and the pages of
+// their tags. If there are more than sitemapSize of them it serves a sitemap
+// index instead, and /sitemap.xml?page=<n> serves the nth sitemap of the
+// index. On the domain of a blog, only the pages of that blog are listed.
+func (app *App) Sitemap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		app.Error(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	var page int
+	if s := r.URL.Query().Get("page"); s != "" {
+		var err error
+		page, err = strconv.Atoi(s)
+		if err != nil || page < 1 {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+	}
+	blogs, err := app.sitemapBlogs(r)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	total := 0
+	for _, blog := range blogs {
+		total += blog.size()
+	}
+	baseURL := app.baseURL(r)
+	var sitemap any
+	var lastMod time.Time
+	if page == 0 && total > sitemapSize {
+		// Working out when each sitemap of the index last changed would
+		// mean going through every URL, so only the index as a whole has
+		// a last modified time.
+		index := &sitemapIndex{}
+		for i := 0; i*sitemapSize < total; i++ {
+			index.Sitemaps = append(index.Sitemaps, sitemapEntry{
+				Loc: baseURL + "/sitemap.xml?page=" + strconv.Itoa(i+1),
+			})
+		}
+		for _, blog := range blogs {
+			if blog.LastMod.After(lastMod) {
+				lastMod = blog.LastMod
+			}
+		}
+		sitemap = index
+	} else {
+		if page == 0 {
+			page = 1
+		}
+		start := (page - 1) * sitemapSize
+		if page > 1 && start >= total {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		urls, err := app.sitemapURLs(r, blogs, start, start+sitemapSize)
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		urlSet := &sitemapURLSet{}
+		for _, url := range urls {
+			urlSet.URLs = append(urlSet.URLs, sitemapEntry{
+				Loc:     url.Loc,
+				LastMod: url.LastMod.UTC().Format(time.RFC3339),
+			})
+			if url.LastMod.After(lastMod) {
+				lastMod = url.LastMod
+			}
+		}
+		sitemap = urlSet
+	}
+	var buf bytes.Buffer
+	_, err = io.WriteString(&buf, xml.Header)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(sitemap)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// Like feeds, sitemaps are revalidated with the ETag or Last-Modified.
+	sum := sha256.Sum256(buf.Bytes())
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", lastMod, bytes.NewReader(buf.Bytes()))
+}
+
+// sitemapBlog is how many URLs a blog has in the sitemap: the index page of
+// the blog, its visible posts and then the pages of their tags.
+type sitemapBlog struct {
+	BlogID ulid.ULID
+	Posts  int
+	Tags   int
+	// LastMod is when the index page of the blog last changed, which is
+	// when its most recently updated post did (see Post.UpdatedAt).
+	LastMod time.Time
+}
+
+// size returns the number of URLs of the blog in the sitemap.
+func (blog sitemapBlog) size() int {
+	return 1 + blog.Posts + blog.Tags
+}
+
+// maxPostLastMod returns when the most recently updated of the posts grouped
+// into row last changed, see Post.UpdatedAt.
+func maxPostLastMod(row *sq.Row, POST POST) time.Time {
+	// SQLite returns the result of an expression as text rather than a
+	// time, which sq.Timestamp knows how to parse.
+	var lastMod sq.Timestamp
+	row.Scan(&lastMod, "MAX(CASE WHEN {} > {} THEN {} ELSE {} END)", POST.UPDATED_AT, POST.PUBLISH_AT, POST.UPDATED_AT, POST.PUBLISH_AT)
+	return lastMod.Time
+}
+
+// sitemapBlogs returns the blogs in the sitemap in the order they are listed,
+// which is every blog or only the blog whose domain the request is on. Their
+// posts and tags are counted by the database, so that only the posts and tags
+// of the requested page of the sitemap ever have to be fetched.
+func (app *App) sitemapBlogs(r *http.Request) ([]sitemapBlog, error) {
+	ctx := r.Context()
+	BLOG := sq.New[BLOG]("")
+	POST := sq.New[POST]("")
+	POST_TAG := sq.New[POST_TAG]("")
+	TAG := sq.New[TAG]("")
+	var blogIDs []ulid.ULID
+	postPredicate := visiblePosts(POST)
+	if blogID, ok := requestBlogDomain(r); ok {
+		blogIDs = []ulid.ULID{blogID}
+		postPredicate = sq.And(POST.BLOG_ID.EqUUID(blogID), postPredicate)
+	} else {
+		var err error
+		blogIDs, err = sq.FetchAllContext(ctx, app.DB, sq.
+			From(BLOG).
+			OrderBy(BLOG.BLOG_ID).
+			SetDialect(app.Dialect),
+			func(row *sq.Row) (blogID ulid.ULID) {
+				row.UUIDField(&blogID, BLOG.BLOG_ID)
+				return blogID
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	blogs := make([]sitemapBlog, len(blogIDs))
+	index := make(map[ulid.ULID]int)
+	for i, blogID := range blogIDs {
+		blogs[i] = sitemapBlog{BlogID: blogID, LastMod: ulid.Time(blogID.Time())}
+		index[blogID] = i
+	}
+	type count struct {
+		BlogID  ulid.ULID
+		Count   int
+		LastMod time.Time
+	}
+	postCounts, err := sq.FetchAllContext(ctx, app.DB, sq.
+		From(POST).
+		Where(postPredicate).
+		GroupBy(POST.BLOG_ID).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (count count) {
+			row.UUIDField(&count.BlogID, POST.BLOG_ID)
+			count.Count = row.Int("COUNT(*)")
+			count.LastMod = maxPostLastMod(row, POST)
+			return count
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, count := range postCounts {
+		i, ok := index[count.BlogID]
+		if !ok {
+			continue
+		}
+		blogs[i].Posts = count.Count
+		if count.LastMod.After(blogs[i].LastMod) {
+			blogs[i].LastMod = count.LastMod
+		}
+	}
+	tagCounts, err := sq.FetchAllContext(ctx, app.DB, sq.
+		From(POST).
+		Join(POST_TAG, POST_TAG.POST_ID.Eq(POST.POST_ID)).
+		Join(TAG, TAG.TAG_ID.Eq(POST_TAG.TAG_ID)).
+		Where(postPredicate).
+		GroupBy(POST.BLOG_ID).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (count count) {
+			row.UUIDField(&count.BlogID, POST.BLOG_ID)
+			count.Count = row.Int("COUNT(DISTINCT {})", TAG.NAME)
+			return count
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, count := range tagCounts {
+		if i, ok := index[count.BlogID]; ok {
+			blogs[i].Tags = count.Count
+		}
+	}
+	return blogs, nil
+}
+
+// sitemapURLs returns the URLs of the sitemap from the start-th up to (but not
+// including) the end-th, going through the blogs in order. A post last
+// changed when it was last updated (see Post.UpdatedAt), while the page of a
+// tag last changed when its most recently updated post did.
+func (app *App) sitemapURLs(r *http.Request, blogs []sitemapBlog, start, end int) ([]sitemapURL, error) {
+	ctx := r.Context()
+	baseURL := app.baseURL(r)
+	POST := sq.New[POST]("")
+	POST_TAG := sq.New[POST_TAG]("")
+	TAG := sq.New[TAG]("")
+	var urls []sitemapURL
+	// offset is the position in the sitemap of the first URL of the blog.
+	offset := 0
+	for _, blog := range blogs {
+		if offset >= end {
+			break
+		}
+		if offset+blog.size() <= start {
+			offset += blog.size()
+			continue
+		}
+		links := blogLinks(r, strings.ToLower(blog.BlogID.String()))
+		links.Root = baseURL
+		predicate := sq.And(
+			POST.BLOG_ID.EqUUID(blog.BlogID),
+			visiblePosts(POST),
+		)
+		// The blog's index page, posts and tags are at positions 0, 1 to
+		// blog.Posts and blog.Posts+1 onwards within the blog, of which
+		// only the positions from lo up to hi are wanted.
+		lo, hi := start-offset, end-offset
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > blog.size() {
+			hi = blog.size()
+		}
+		if lo == 0 {
+			urls = append(urls, sitemapURL{Loc: links.Blog(), LastMod: blog.LastMod})
+		}
+		// Positions within the blog's posts and within its tags.
+		postLo, postHi := lo-1, hi-1
+		if postLo < 0 {
+			postLo = 0
+		}
+		if postHi > blog.Posts {
+			postHi = blog.Posts
+		}
+		tagLo, tagHi := lo-1-blog.Posts, hi-1-blog.Posts
+		if tagLo < 0 {
+			tagLo = 0
+		}
+		if postLo < postHi {
+			posts, err := sq.FetchAllContext(ctx, app.DB, sq.
+				From(POST).
+				Where(predicate).
+				OrderBy(POST.POST_ID).
+				Limit(postHi-postLo).
+				Offset(postLo).
+				SetDialect(app.Dialect),
+				func(row *sq.Row) (post Post) {
+					row.UUIDField(&post.PostID, POST.POST_ID)
+					post.EditedAt = row.TimeField(POST.UPDATED_AT)
+					post.Status = row.StringField(POST.STATUS)
+					post.PublishAt = row.TimeField(POST.PUBLISH_AT)
+					post.Slug = row.StringField(POST.SLUG)
+					return post
+				},
+			)
+			if err != nil {
+				return nil, err
+			}
+			for _, post := range posts {
+				urls = append(urls, sitemapURL{Loc: links.Post(post.Slug), LastMod: post.UpdatedAt()})
+			}
+		}
+		if tagLo < tagHi {
+			tags, err := sq.FetchAllContext(ctx, app.DB, sq.
+				From(TAG).
+				Join(POST_TAG, POST_TAG.TAG_ID.Eq(TAG.TAG_ID)).
+				Join(POST, POST.POST_ID.Eq(POST_TAG.POST_ID)).
+				Where(predicate).
+				GroupBy(TAG.NAME).
+				OrderBy(TAG.NAME).
+				Limit(tagHi-tagLo).
+				Offset(tagLo).
+				SetDialect(app.Dialect),
+				func(row *sq.Row) sitemapURL {
+					return sitemapURL{
+						Loc:     links.Tag(row.StringField(TAG.NAME)),
+						LastMod: maxPostLastMod(row, POST),
+					}
+				},
+			)
+			if err != nil {
+				return nil, err
+			}
+			urls = append(urls, tags...)
+		}
+		offset += blog.size()
+	}
+	return urls, nil
+}
+
+// Robots serves /robots.txt, which is App.RobotsTxt if it is set. Otherwise
+// it keeps crawlers out of the pages that are only of use to logged in users
+// and points them to the sitemap. The domain of a blog has only the pages of
+// the blog, so its robots.txt just points to its sitemap.
+func (app *App) Robots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		app.Error(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	robotsTxt := app.RobotsTxt
+	if _, ok := requestBlogDomain(r); ok {
+		robotsTxt = "User-agent: *\n" +
+			"Disallow: /comment/\n" +
+			"\n" +
+			"Sitemap: " + app.baseURL(r) + "/sitemap.xml\n"
+	} else if robotsTxt == "" {
+		robotsTxt = "User-agent: *\n" +
+			"Disallow: /login\n" +
+			"Disallow: /logout\n" +
+			"Disallow: /register\n" +
+			"Disallow: /user/\n" +
+			"Disallow: /u/\n" +
+			"Disallow: /note/\n" +
+			"Disallow: /n/\n" +
+			"Disallow: /post/\n" +
+			"Disallow: /comment/\n" +
+			"\n" +
+			"Sitemap: " + app.baseURL(r) + "/sitemap.xml\n"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := io.WriteString(w, robotsTxt)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,180 @@
+package notebrew
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// maxSlugLength is the maximum number of characters in a generated slug.
+const maxSlugLength = 80
+
+// errSlugTaken is returned when a post is given a slug that another post in
+// the same blog already has.
+var errSlugTaken = errors.New("slug is already used by another post in this blog")
+
+// slugify turns a title into a slug: its letters and digits in lowercase, with
+// every run of other characters replaced by a single hyphen. Apostrophes are
+// dropped so that "don't" becomes "dont" rather than "don-t". It returns an
+// empty string if the title has no letters or digits.
+func slugify(title string) string {
+	var b strings.Builder
+	hyphen := false
+	n := 0
+	for _, char := range strings.ToLower(title) {
+		if char == '\'' || char == '’' {
+			continue
+		}
+		if !unicode.IsLetter(char) && !unicode.IsDigit(char) {
+			hyphen = true
+			continue
+		}
+		if n == maxSlugLength {
+			break
+		}
+		if hyphen && b.Len() > 0 {
+			b.WriteByte('-')
+			n++
+			if n == maxSlugLength {
+				break
+			}
+		}
+		hyphen = false
+		b.WriteRune(char)
+		n++
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// uniquePostSlug returns slug, or slug with the smallest numeric suffix
+// ("-2", "-3", ...) that makes it unique among the posts of a blog other
+// than postID.
+func (app *App) uniquePostSlug(ctx context.Context, db sq.DB, blogID ulid.ULID, postID ulid.ULID, slug string) (string, error) {
+	if slug == "" {
+		slug = "post"
+	}
+	POST := sq.New[POST]("")
+	candidate := slug
+	for i := 2; ; i++ {
+		exists, err := sq.FetchExistsContext(ctx, db, sq.
+			SelectOne().
+			From(POST).
+			Where(
+				POST.BLOG_ID.EqUUID(blogID),
+				POST.SLUG.EqString(candidate),
+				POST.POST_ID.NeUUID(postID),
+			).
+			SetDialect(app.Dialect),
+		)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		suffix := "-" + strconv.Itoa(i)
+		candidate = slug
+		if utf8.RuneCountInString(candidate)+len(suffix) > maxSlugLength {
+			candidate = strings.TrimSuffix(string([]rune(candidate)[:maxSlugLength-len(suffix)]), "-")
+		}
+		candidate += suffix
+	}
+}
+
+// claimPostSlug records that a post has changed its slug from oldSlug to
+// newSlug, so that its old URL redirects to the new one. A post taking over a
+// slug that used to belong to another post (or to itself) removes it from the
+// slug history, since the slug now leads to that post. The caller updates
+// POST.SLUG itself. oldSlug is empty for new posts.
+func (app *App) claimPostSlug(ctx context.Context, db sq.DB, blogID ulid.ULID, postID ulid.ULID, oldSlug, newSlug string) error {
+	if oldSlug == newSlug {
+		return nil
+	}
+	POST_SLUG_HISTORY := sq.New[POST_SLUG_HISTORY]("")
+	_, err := sq.ExecContext(ctx, db, sq.
+		DeleteFrom(POST_SLUG_HISTORY).
+		Where(
+			POST_SLUG_HISTORY.BLOG_ID.EqUUID(blogID),
+			POST_SLUG_HISTORY.SLUG.EqString(newSlug),
+		).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	if oldSlug == "" {
+		return nil
+	}
+	_, err = sq.ExecContext(ctx, db, sq.
+		InsertInto(POST_SLUG_HISTORY).
+		ColumnValues(func(col *sq.Column) {
+			col.SetUUID(POST_SLUG_HISTORY.BLOG_ID, blogID)
+			col.SetString(POST_SLUG_HISTORY.SLUG, oldSlug)
+			col.SetUUID(POST_SLUG_HISTORY.POST_ID, postID)
+		}).
+		SetDialect(app.Dialect),
+	)
+	return err
+}
+
+// formerPostSlug returns the ID of the post that used to have a slug in a
+// blog. It returns sql.ErrNoRows if no post ever had that slug.
+func (app *App) formerPostSlug(ctx context.Context, blogID ulid.ULID, slug string) (ulid.ULID, error) {
+	POST_SLUG_HISTORY := sq.New[POST_SLUG_HISTORY]("")
+	return sq.FetchOneContext(ctx, app.DB, sq.
+		From(POST_SLUG_HISTORY).
+		Where(
+			POST_SLUG_HISTORY.BLOG_ID.EqUUID(blogID),
+			POST_SLUG_HISTORY.SLUG.EqString(slug),
+		).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (postID ulid.ULID) {
+			row.UUIDField(&postID, POST_SLUG_HISTORY.POST_ID)
+			return postID
+		},
+	)
+}
+
+// AssignPostSlugs gives the posts that don't have a slug, which were written
+// before posts had slugs, one generated from their title.
+func (app *App) AssignPostSlugs(ctx context.Context) error {
+	POST := sq.New[POST]("")
+	posts, err := sq.FetchAllContext(ctx, app.DB, sq.
+		From(POST).
+		Where(POST.SLUG.IsNull()).
+		OrderBy(POST.POST_ID).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (post Post) {
+			row.UUIDField(&post.PostID, POST.POST_ID)
+			row.UUIDField(&post.Blog.BlogID, POST.BLOG_ID)
+			post.Title = row.StringField(POST.TITLE)
+			return post
+		},
+	)
+	if err != nil {
+		return err
+	}
+	for _, post := range posts {
+		slug, err := app.uniquePostSlug(ctx, app.DB, post.Blog.BlogID, post.PostID, slugify(post.Title))
+		if err != nil {
+			return err
+		}
+		_, err = sq.ExecContext(ctx, app.DB, sq.
+			Update(POST).
+			Set(POST.SLUG.SetString(slug)).
+			Where(POST.POST_ID.EqUUID(post.PostID)).
+			SetDialect(app.Dialect),
+		)
+		if err != nil {
+			return fmt.Errorf("post %s: %w", post.PostIDString(), err)
+		}
+	}
+	return nil
+}
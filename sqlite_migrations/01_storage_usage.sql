@@ -0,0 +1,6 @@
+-- Count the notes written before the storage used by each user was tracked.
+-- The sizes of the images uploaded before then are unknown, so they don't
+-- count towards anyone's quota.
+UPDATE users SET
+    note_count = (SELECT COUNT(*) FROM note WHERE note.user_id = users.user_id)
+    ,note_bytes = (SELECT COALESCE(SUM(LENGTH(CAST(body AS BLOB))), 0) FROM note WHERE note.user_id = users.user_id);
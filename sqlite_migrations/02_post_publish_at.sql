@@ -0,0 +1,17 @@
+-- Posts written before they could be scheduled were published when they were
+-- created, which is the timestamp in the first 6 bytes of their ULID.
+UPDATE post SET publish_at = strftime('%Y-%m-%d %H:%M:%f+00:00', (
+    (instr('0123456789ABCDEF', substr(hex(post_id), 1, 1)) - 1) * 17592186044416
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 2, 1)) - 1) * 1099511627776
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 3, 1)) - 1) * 68719476736
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 4, 1)) - 1) * 4294967296
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 5, 1)) - 1) * 268435456
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 6, 1)) - 1) * 16777216
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 7, 1)) - 1) * 1048576
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 8, 1)) - 1) * 65536
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 9, 1)) - 1) * 4096
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 10, 1)) - 1) * 256
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 11, 1)) - 1) * 16
+    + (instr('0123456789ABCDEF', substr(hex(post_id), 12, 1)) - 1)
+) / 1000.0, 'unixepoch')
+WHERE status = 'published' AND publish_at IS NULL;
@@ -12,6 +12,11 @@ CREATE VIRTUAL TABLE IF NOT EXISTS note_fts USING FTS5 (
     ,content_rowid='rowid'
 );
 
+-- Repopulate the index from the existing notes, since it was just dropped.
+-- Notes in the trash stay indexed (so that restoring a note does not have to
+-- touch the index), search queries filter them out instead.
+INSERT INTO note_fts (note_fts) VALUES ('rebuild');
+
 CREATE TRIGGER IF NOT EXISTS note_after_insert_trigger AFTER INSERT ON note BEGIN
     INSERT INTO note_fts (ROWID, body) VALUES (NEW.ROWID, NEW.body);
 END;
@@ -20,7 +25,9 @@ CREATE TRIGGER IF NOT EXISTS note_after_delete_trigger AFTER DELETE ON note BEGI
     INSERT INTO note_fts (note_fts, ROWID, body) VALUES ('delete', OLD.ROWID, OLD.body);
 END;
 
-CREATE TRIGGER IF NOT EXISTS note_after_update_trigger AFTER UPDATE ON note BEGIN
+-- Only changes to the body need to be reindexed, moving a note in or out of
+-- the trash (which updates deleted_at) does not.
+CREATE TRIGGER IF NOT EXISTS note_after_update_trigger AFTER UPDATE OF body ON note BEGIN
     INSERT INTO note_fts (note_fts, ROWID, body) VALUES ('delete', OLD.ROWID, OLD.body);
     INSERT INTO note_fts (ROWID, body) VALUES (NEW.ROWID, NEW.body);
 END;
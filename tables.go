@@ -66,10 +66,20 @@ func Automigrate(dialect string, db *sql.DB) error {
 
 type USERS struct {
 	sq.TableStruct
-	USER_ID       sq.UUIDField   `ddl:"primarykey"`
-	EMAIL         sq.StringField `ddl:"unique notnull len=255"`
-	NAME          sq.StringField `ddl:"len=255"`
-	PASSWORD_HASH sq.StringField `ddl:"len=255"`
+	USER_ID          sq.UUIDField   `ddl:"primarykey"`
+	EMAIL            sq.StringField `ddl:"unique notnull len=255"`
+	NAME             sq.StringField `ddl:"len=255"`
+	PASSWORD_HASH    sq.StringField `ddl:"len=255"`
+	LAST_NOTE_NUMBER sq.NumberField `ddl:"notnull default=0"`
+	// IMAGE_BYTES, NOTE_COUNT and NOTE_BYTES track the storage used by the
+	// user. The QUOTA_* columns override App.DefaultQuota for the user if
+	// they are not NULL.
+	IMAGE_BYTES       sq.NumberField `ddl:"type=BIGINT notnull default=0"`
+	NOTE_COUNT        sq.NumberField `ddl:"type=BIGINT notnull default=0"`
+	NOTE_BYTES        sq.NumberField `ddl:"type=BIGINT notnull default=0"`
+	QUOTA_IMAGE_BYTES sq.NumberField `ddl:"type=BIGINT"`
+	QUOTA_NOTES       sq.NumberField `ddl:"type=BIGINT"`
+	QUOTA_NOTE_BYTES  sq.NumberField `ddl:"type=BIGINT"`
 }
 
 type NOTE struct {
@@ -78,6 +88,16 @@ type NOTE struct {
 	NOTE_NUMBER    sq.NumberField
 	BODY           sq.StringField `ddl:"len=65536"`
 	FTS            sq.AnyField    `ddl:"dialect=postgres type=TSVECTOR index={. using=gin}"`
+	DELETED_AT     sq.TimeField
+}
+
+type NOTE_REVISION struct {
+	sq.TableStruct
+	REVISION_ID sq.UUIDField `ddl:"primarykey"`
+	USER_ID     sq.UUIDField
+	NOTE_NUMBER sq.NumberField
+	BODY        sq.StringField `ddl:"len=65536"`
+	_           struct{}       `ddl:"foreignkey={user_id,note_number references=note ondelete=cascade index}"`
 }
 
 type NOTE_FTS struct {
@@ -91,6 +111,23 @@ type NOTE_FTS struct {
 	_              struct{}       `ddl:"mysql:index={body using=fulltext}"`
 }
 
+type IMAGE struct {
+	sq.TableStruct
+	IMAGE_ID     sq.UUIDField   `ddl:"primarykey"`
+	USER_ID      sq.UUIDField   `ddl:"references={users index}"`
+	CONTENT_TYPE sq.StringField `ddl:"notnull len=255"`
+	WIDTH        sq.NumberField
+	HEIGHT       sq.NumberField
+	HASH         sq.StringField `ddl:"len=64 references={image_blob index}"`
+	SIZE         sq.NumberField `ddl:"type=BIGINT"`
+}
+
+type IMAGE_BLOB struct {
+	sq.TableStruct
+	HASH      sq.StringField `ddl:"primarykey len=64"`
+	REF_COUNT sq.NumberField `ddl:"notnull default=0"`
+}
+
 type FLASH_SESSION struct {
 	sq.TableStruct
 	SESSION_ID sq.UUIDField `ddl:"primarykey"`
@@ -102,3 +139,106 @@ type LOGIN_SESSION struct {
 	SESSION_ID sq.UUIDField `ddl:"primarykey"`
 	USER_ID    sq.UUIDField
 }
+
+type BLOG struct {
+	sq.TableStruct
+	BLOG_ID     sq.UUIDField   `ddl:"primarykey"`
+	USER_ID     sq.UUIDField   `ddl:"notnull references={users index}"`
+	TITLE       sq.StringField `ddl:"notnull len=255"`
+	DESCRIPTION sq.StringField `ddl:"len=1000"`
+	// COMMENTS_ENABLED is whether readers can comment on the posts of the
+	// blog.
+	COMMENTS_ENABLED sq.BooleanField `ddl:"notnull default=false"`
+	// COMMENTS_MODERATED is whether comments wait for the owner of the blog
+	// to approve them before they are shown.
+	COMMENTS_MODERATED sq.BooleanField `ddl:"notnull default=true"`
+	// ANONYMOUS_COMMENTS is whether readers can comment without logging in,
+	// as long as they pass a captcha.
+	ANONYMOUS_COMMENTS sq.BooleanField `ddl:"notnull default=false"`
+}
+
+type POST struct {
+	sq.TableStruct `ddl:"unique=blog_id,source_note_number unique=blog_id,slug"`
+	POST_ID        sq.UUIDField   `ddl:"primarykey"`
+	BLOG_ID        sq.UUIDField   `ddl:"notnull references={blog index}"`
+	TITLE          sq.StringField `ddl:"notnull len=255"`
+	BODY           sq.StringField `ddl:"len=65536"`
+	// SOURCE_NOTE_NUMBER is the number of the note (belonging to the owner
+	// of the blog) that the post was published from, if any.
+	SOURCE_NOTE_NUMBER sq.NumberField
+	// UPDATED_AT is when the post was last edited, or NULL if it hasn't
+	// been edited since it was published.
+	UPDATED_AT sq.TimeField
+	// STATUS is "draft", "scheduled" or "published".
+	STATUS sq.StringField `ddl:"notnull len=10 default='published'"`
+	// PUBLISH_AT is when the post is to be (or was) published, or NULL if
+	// it is a draft.
+	PUBLISH_AT sq.TimeField `ddl:"index"`
+	// SLUG identifies the post in its URL, /blog/<blogID>/<slug>.
+	SLUG sq.StringField `ddl:"len=255"`
+}
+
+// BLOG_TEMPLATE holds the templates of a blog's theme that its owner has
+// changed from the default theme.
+type BLOG_TEMPLATE struct {
+	sq.TableStruct `ddl:"primarykey=blog_id,name"`
+	BLOG_ID        sq.UUIDField   `ddl:"notnull references={blog}"`
+	NAME           sq.StringField `ddl:"notnull len=50"`
+	BODY           sq.StringField `ddl:"notnull len=65536"`
+}
+
+// POST_SLUG_HISTORY holds the slugs that posts used to have, so that their
+// old URLs can be redirected to the current ones.
+type POST_SLUG_HISTORY struct {
+	sq.TableStruct `ddl:"primarykey=blog_id,slug"`
+	BLOG_ID        sq.UUIDField   `ddl:"notnull references={blog}"`
+	SLUG           sq.StringField `ddl:"notnull len=255"`
+	POST_ID        sq.UUIDField   `ddl:"notnull references={post index}"`
+}
+
+// BLOG_DOMAIN maps domains to the blogs served at their root, such that a
+// request for a blog's domain is served its pages rather than the app.
+type BLOG_DOMAIN struct {
+	sq.TableStruct
+	// DOMAIN is the lowercase hostname, without a port.
+	DOMAIN  sq.StringField `ddl:"primarykey len=255"`
+	BLOG_ID sq.UUIDField   `ddl:"notnull references={blog index}"`
+}
+
+// TAG is a tag that a user has given to their notes or posts. Tags are shared
+// between the notes of a user and the posts of their blogs.
+type TAG struct {
+	sq.TableStruct `ddl:"unique=user_id,name"`
+	TAG_ID         sq.UUIDField   `ddl:"primarykey"`
+	USER_ID        sq.UUIDField   `ddl:"notnull references={users index}"`
+	NAME           sq.StringField `ddl:"notnull len=50"`
+}
+
+type NOTE_TAG struct {
+	sq.TableStruct `ddl:"primarykey=user_id,note_number,tag_id"`
+	USER_ID        sq.UUIDField
+	NOTE_NUMBER    sq.NumberField
+	TAG_ID         sq.UUIDField `ddl:"notnull references={tag index}"`
+	_              struct{}     `ddl:"foreignkey={user_id,note_number references=note ondelete=cascade}"`
+}
+
+type POST_TAG struct {
+	sq.TableStruct `ddl:"primarykey=post_id,tag_id"`
+	POST_ID        sq.UUIDField `ddl:"notnull references={post ondelete=cascade}"`
+	TAG_ID         sq.UUIDField `ddl:"notnull references={tag index}"`
+}
+
+// COMMENT is a comment by a reader on a post.
+type COMMENT struct {
+	sq.TableStruct
+	COMMENT_ID sq.UUIDField `ddl:"primarykey"`
+	POST_ID    sq.UUIDField `ddl:"notnull references={post ondelete=cascade index}"`
+	// USER_ID is the user who wrote the comment, or NULL if it was written
+	// without logging in.
+	USER_ID sq.UUIDField   `ddl:"references={users index}"`
+	NAME    sq.StringField `ddl:"len=100"`
+	BODY    sq.StringField `ddl:"notnull len=5000"`
+	// STATUS is "pending" until the owner of the blog approves or rejects
+	// the comment, after which it is "approved" or "rejected".
+	STATUS sq.StringField `ddl:"notnull len=10 default='pending' index"`
+}
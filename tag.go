@@ -0,0 +1,606 @@
+package notebrew
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// maxTagLength is the maximum number of characters in a tag, matching the
+// length of TAG.NAME.
+const maxTagLength = 50
+
+// maxTags is the maximum number of tags on a note or post.
+const maxTags = 20
+
+// normalizeTag normalizes a tag. Tags are case-insensitive, so they are
+// lowercased, and the whitespace inside a tag is replaced by hyphens so that
+// it reads the same in a URL.
+func normalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+}
+
+// parseTags parses a list of tags separated by commas or newlines, normalized
+// with normalizeTag. Duplicate tags are dropped and the tags are returned in
+// alphabetical order.
+func parseTags(s string) ([]string, error) {
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, tag := range strings.FieldsFunc(s, func(char rune) bool { return char == ',' || char == '\n' }) {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		// Tags are path segments of the URLs of tag pages, and the names
+		// of directories in an exported site.
+		if strings.ContainsAny(tag, `/\`) || tag == "." || tag == ".." {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("more than %d tags", maxTags)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// readTagsField reads the comma-separated tags in the "tags" field of a parsed
+// form. It returns nil tags if the form has no tags field, which leaves the
+// tags of the note or post unchanged.
+func readTagsField(r *http.Request) ([]string, error) {
+	if !r.PostForm.Has("tags") {
+		return nil, nil
+	}
+	return parseTags(r.PostForm.Get("tags"))
+}
+
+// tagIDs returns the IDs of a user's tags, creating the tags that the user
+// doesn't have yet.
+func (app *App) tagIDs(ctx context.Context, tx *sql.Tx, userID ulid.ULID, tags []string) ([]ulid.ULID, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	names := make([]any, len(tags))
+	for i, tag := range tags {
+		names[i] = tag
+	}
+	TAG := sq.New[TAG]("")
+	existing := make(map[string]ulid.ULID)
+	cursor, err := sq.FetchCursorContext(ctx, tx, sq.
+		From(TAG).
+		Where(
+			TAG.USER_ID.EqUUID(userID),
+			TAG.NAME.In(names),
+		).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (tag struct {
+			TagID ulid.ULID
+			Name  string
+		}) {
+			row.UUIDField(&tag.TagID, TAG.TAG_ID)
+			tag.Name = row.StringField(TAG.NAME)
+			return tag
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	for cursor.Next() {
+		tag, err := cursor.Result()
+		if err != nil {
+			return nil, err
+		}
+		existing[tag.Name] = tag.TagID
+	}
+	err = cursor.Close()
+	if err != nil {
+		return nil, err
+	}
+	tagIDs := make([]ulid.ULID, len(tags))
+	for i, tag := range tags {
+		tagID, ok := existing[tag]
+		if !ok {
+			tagID = ulid.Make()
+			_, err = sq.ExecContext(ctx, tx, sq.
+				InsertInto(TAG).
+				ColumnValues(func(col *sq.Column) {
+					col.SetUUID(TAG.TAG_ID, tagID)
+					col.SetUUID(TAG.USER_ID, userID)
+					col.SetString(TAG.NAME, tag)
+				}).
+				SetDialect(app.Dialect),
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+		tagIDs[i] = tagID
+	}
+	return tagIDs, nil
+}
+
+// setNoteTags replaces the tags of a note.
+func (app *App) setNoteTags(ctx context.Context, tx *sql.Tx, userID ulid.ULID, noteNumber int, tags []string) error {
+	NOTE_TAG := sq.New[NOTE_TAG]("")
+	_, err := sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(NOTE_TAG).
+		Where(
+			NOTE_TAG.USER_ID.EqUUID(userID),
+			NOTE_TAG.NOTE_NUMBER.EqInt(noteNumber),
+		).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	tagIDs, err := app.tagIDs(ctx, tx, userID, tags)
+	if err != nil {
+		return err
+	}
+	for _, tagID := range tagIDs {
+		_, err = sq.ExecContext(ctx, tx, sq.
+			InsertInto(NOTE_TAG).
+			ColumnValues(func(col *sq.Column) {
+				col.SetUUID(NOTE_TAG.USER_ID, userID)
+				col.SetInt(NOTE_TAG.NOTE_NUMBER, noteNumber)
+				col.SetUUID(NOTE_TAG.TAG_ID, tagID)
+			}).
+			SetDialect(app.Dialect),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return app.deleteUnusedTags(ctx, tx, userID)
+}
+
+// setPostTags replaces the tags of a post. userID is the owner of the blog of
+// the post.
+func (app *App) setPostTags(ctx context.Context, tx *sql.Tx, userID ulid.ULID, postID ulid.ULID, tags []string) error {
+	POST_TAG := sq.New[POST_TAG]("")
+	_, err := sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(POST_TAG).
+		Where(POST_TAG.POST_ID.EqUUID(postID)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	tagIDs, err := app.tagIDs(ctx, tx, userID, tags)
+	if err != nil {
+		return err
+	}
+	for _, tagID := range tagIDs {
+		_, err = sq.ExecContext(ctx, tx, sq.
+			InsertInto(POST_TAG).
+			ColumnValues(func(col *sq.Column) {
+				col.SetUUID(POST_TAG.POST_ID, postID)
+				col.SetUUID(POST_TAG.TAG_ID, tagID)
+			}).
+			SetDialect(app.Dialect),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return app.deleteUnusedTags(ctx, tx, userID)
+}
+
+// deleteUnusedTags deletes the tags of a user that are no longer on any of
+// their notes or posts.
+func (app *App) deleteUnusedTags(ctx context.Context, tx *sql.Tx, userID ulid.ULID) error {
+	TAG := sq.New[TAG]("")
+	NOTE_TAG := sq.New[NOTE_TAG]("")
+	POST_TAG := sq.New[POST_TAG]("")
+	_, err := sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(TAG).
+		Where(
+			TAG.USER_ID.EqUUID(userID),
+			sq.Expr("NOT EXISTS ({})", sq.SelectOne().From(NOTE_TAG).Where(NOTE_TAG.TAG_ID.Eq(TAG.TAG_ID))),
+			sq.Expr("NOT EXISTS ({})", sq.SelectOne().From(POST_TAG).Where(POST_TAG.TAG_ID.Eq(TAG.TAG_ID))),
+		).
+		SetDialect(app.Dialect),
+	)
+	return err
+}
+
+// noteTagNames returns the tags of a note in alphabetical order.
+func (app *App) noteTagNames(ctx context.Context, db sq.DB, userID ulid.ULID, noteNumber int) ([]string, error) {
+	NOTE_TAG := sq.New[NOTE_TAG]("")
+	TAG := sq.New[TAG]("")
+	return sq.FetchAllContext(ctx, db, sq.
+		From(NOTE_TAG).
+		Join(TAG, TAG.TAG_ID.Eq(NOTE_TAG.TAG_ID)).
+		Where(
+			NOTE_TAG.USER_ID.EqUUID(userID),
+			NOTE_TAG.NOTE_NUMBER.EqInt(noteNumber),
+		).
+		OrderBy(TAG.NAME).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) string {
+			return row.StringField(TAG.NAME)
+		},
+	)
+}
+
+// noteTagged matches the notes that have a tag.
+func noteTagged(NOTE NOTE, tag string) sq.Predicate {
+	NOTE_TAG := sq.New[NOTE_TAG]("")
+	TAG := sq.New[TAG]("")
+	return sq.Exists(sq.
+		SelectOne().
+		From(NOTE_TAG).
+		Join(TAG, TAG.TAG_ID.Eq(NOTE_TAG.TAG_ID)).
+		Where(
+			NOTE_TAG.USER_ID.Eq(NOTE.USER_ID),
+			NOTE_TAG.NOTE_NUMBER.Eq(NOTE.NOTE_NUMBER),
+			TAG.NAME.EqString(tag),
+		),
+	)
+}
+
+// postTagged matches the posts that have a tag.
+func postTagged(POST POST, tag string) sq.Predicate {
+	POST_TAG := sq.New[POST_TAG]("")
+	TAG := sq.New[TAG]("")
+	return sq.Exists(sq.
+		SelectOne().
+		From(POST_TAG).
+		Join(TAG, TAG.TAG_ID.Eq(POST_TAG.TAG_ID)).
+		Where(
+			POST_TAG.POST_ID.Eq(POST.POST_ID),
+			TAG.NAME.EqString(tag),
+		),
+	)
+}
+
+// noteTags returns the tags of the notes of a user matched by predicate, by
+// note number.
+func (app *App) noteTags(ctx context.Context, userID ulid.ULID, predicate sq.Predicate) (map[int][]string, error) {
+	NOTE := sq.New[NOTE]("")
+	NOTE_TAG := sq.New[NOTE_TAG]("")
+	TAG := sq.New[TAG]("")
+	tags := make(map[int][]string)
+	cursor, err := sq.FetchCursorContext(ctx, app.DB, sq.
+		From(NOTE_TAG).
+		Join(TAG, TAG.TAG_ID.Eq(NOTE_TAG.TAG_ID)).
+		Join(NOTE, NOTE.USER_ID.Eq(NOTE_TAG.USER_ID), NOTE.NOTE_NUMBER.Eq(NOTE_TAG.NOTE_NUMBER)).
+		Where(
+			NOTE_TAG.USER_ID.EqUUID(userID),
+			predicate,
+		).
+		OrderBy(TAG.NAME).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (result struct {
+			NoteNumber int
+			Name       string
+		}) {
+			result.NoteNumber = row.IntField(NOTE_TAG.NOTE_NUMBER)
+			result.Name = row.StringField(TAG.NAME)
+			return result
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	for cursor.Next() {
+		result, err := cursor.Result()
+		if err != nil {
+			return nil, err
+		}
+		tags[result.NoteNumber] = append(tags[result.NoteNumber], result.Name)
+	}
+	return tags, cursor.Close()
+}
+
+// postTags returns the tags of the posts matched by predicate, by post ID.
+func (app *App) postTags(ctx context.Context, predicate sq.Predicate) (map[ulid.ULID][]string, error) {
+	POST := sq.New[POST]("")
+	POST_TAG := sq.New[POST_TAG]("")
+	TAG := sq.New[TAG]("")
+	tags := make(map[ulid.ULID][]string)
+	cursor, err := sq.FetchCursorContext(ctx, app.DB, sq.
+		From(POST_TAG).
+		Join(TAG, TAG.TAG_ID.Eq(POST_TAG.TAG_ID)).
+		Join(POST, POST.POST_ID.Eq(POST_TAG.POST_ID)).
+		Where(predicate).
+		OrderBy(TAG.NAME).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (result struct {
+			PostID ulid.ULID
+			Name   string
+		}) {
+			row.UUIDField(&result.PostID, POST_TAG.POST_ID)
+			result.Name = row.StringField(TAG.NAME)
+			return result
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	for cursor.Next() {
+		result, err := cursor.Result()
+		if err != nil {
+			return nil, err
+		}
+		tags[result.PostID] = append(tags[result.PostID], result.Name)
+	}
+	return tags, cursor.Close()
+}
+
+// fillPostTags sets the tags of posts, which are all of the posts matched by
+// predicate or a subset of them.
+func (app *App) fillPostTags(ctx context.Context, posts []Post, predicate sq.Predicate) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	tags, err := app.postTags(ctx, predicate)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].Tags = tags[posts[i].PostID]
+	}
+	return nil
+}
+
+// userNoteTags returns the tags on the notes of a user that aren't in the
+// trash, in alphabetical order.
+func (app *App) userNoteTags(ctx context.Context, userID ulid.ULID) ([]string, error) {
+	NOTE := sq.New[NOTE]("")
+	NOTE_TAG := sq.New[NOTE_TAG]("")
+	TAG := sq.New[TAG]("")
+	return sq.FetchAllContext(ctx, app.DB, sq.
+		From(TAG).
+		Join(NOTE_TAG, NOTE_TAG.TAG_ID.Eq(TAG.TAG_ID)).
+		Join(NOTE, NOTE.USER_ID.Eq(NOTE_TAG.USER_ID), NOTE.NOTE_NUMBER.Eq(NOTE_TAG.NOTE_NUMBER)).
+		Where(
+			TAG.USER_ID.EqUUID(userID),
+			NOTE.DELETED_AT.IsNull(),
+		).
+		GroupBy(TAG.NAME).
+		OrderBy(TAG.NAME).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) string {
+			return row.StringField(TAG.NAME)
+		},
+	)
+}
+
+// blogTags returns the tags on the visible posts of a blog, in alphabetical
+// order.
+func (app *App) blogTags(ctx context.Context, blogID ulid.ULID) ([]string, error) {
+	POST := sq.New[POST]("")
+	POST_TAG := sq.New[POST_TAG]("")
+	TAG := sq.New[TAG]("")
+	return sq.FetchAllContext(ctx, app.DB, sq.
+		From(TAG).
+		Join(POST_TAG, POST_TAG.TAG_ID.Eq(TAG.TAG_ID)).
+		Join(POST, POST.POST_ID.Eq(POST_TAG.POST_ID)).
+		Where(
+			POST.BLOG_ID.EqUUID(blogID),
+			visiblePosts(POST),
+		).
+		GroupBy(TAG.NAME).
+		OrderBy(TAG.NAME).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) string {
+			return row.StringField(TAG.NAME)
+		},
+	)
+}
+
+// noteTagsAPI gets or replaces the tags of a note as plain text, one tag per
+// line. The tags are replaced with the "tags" form field for HTML forms, or
+// with the request body (separated by commas or newlines) otherwise.
+func (app *App) noteTagsAPI(w http.ResponseWriter, r *http.Request, userID ulid.ULID, noteNumber int) {
+	NOTE := sq.New[NOTE]("")
+	trashed, err := sq.FetchOneContext(r.Context(), app.DB, sq.
+		From(NOTE).
+		Where(
+			NOTE.USER_ID.EqUUID(userID),
+			NOTE.NOTE_NUMBER.EqInt(noteNumber),
+		).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) bool {
+			return row.NullTimeField(NOTE.DELETED_AT).Valid
+		},
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if r.Method == "GET" {
+		if trashed {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		tags, err := app.noteTags(r.Context(), userID, NOTE.NOTE_NUMBER.EqInt(noteNumber))
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		var buf bytes.Buffer
+		for _, tag := range tags[noteNumber] {
+			buf.WriteString(tag + "\n")
+		}
+		_, err = buf.WriteTo(w)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if trashed {
+		app.Error(w, r, http.StatusConflict, errNoteInTrash)
+		return
+	}
+	tags, err := readNoteTags(w, r)
+	if err != nil {
+		app.Error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err = app.replaceNoteTags(r.Context(), userID, noteNumber, tags)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if r.Method == "PUT" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/note/"+strconv.Itoa(noteNumber)+"/?edit", http.StatusFound)
+}
+
+// readNoteTags reads the tags of a note from a request to replace them. HTML
+// forms submit the tags in the "tags" form field, any other content type is
+// treated as the raw list of tags.
+func readNoteTags(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxTags*(maxTagLength+1))
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/x-www-form-urlencoded" || contentType == "multipart/form-data" {
+		err := r.ParseMultipartForm(1 << 20 /* 1MB */)
+		if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return nil, err
+		}
+		return parseTags(r.PostForm.Get("tags"))
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseTags(string(b))
+}
+
+// replaceNoteTags replaces the tags of a note.
+func (app *App) replaceNoteTags(ctx context.Context, userID ulid.ULID, noteNumber int, tags []string) error {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = app.setNoteTags(ctx, tx, userID, noteNumber, tags)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// blogTag renders the page of a tag of a blog, which lists the visible posts
+// of the blog with that tag, at /blog/<blogID>/tag/<tag>.
+func (app *App) blogTag(w http.ResponseWriter, r *http.Request, base32BlogID string, tag string) {
+	if len(base32BlogID) != ulid.EncodedSize {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	if lower := strings.ToLower(base32BlogID); lower != base32BlogID || strings.ToLower(tag) != tag {
+		http.Redirect(w, r, blogLinks(r, lower).Tag(strings.ToLower(tag)), http.StatusMovedPermanently)
+		return
+	}
+	blogID, err := ulid.Parse(base32BlogID)
+	if err != nil {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	blog, err := app.fetchBlog(r.Context(), blogID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.Error(w, r, http.StatusNotFound, nil)
+			return
+		}
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	currentUserID, loggedIn := app.CurrentUserID(r)
+	var buf bytes.Buffer
+	found, err := app.renderBlogTag(r.Context(), &buf, blog, tag, blogLinks(r, blog.BlogIDString()), loggedIn && currentUserID == blog.UserID)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// A tag that isn't on any visible post doesn't exist as far as the
+	// readers of the blog are concerned.
+	if !found {
+		app.Error(w, r, http.StatusNotFound, nil)
+		return
+	}
+	setThemeHeaders(w)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// renderBlogTag renders the page of a tag of a blog with its theme, which
+// lists the visible posts of the blog with that tag starting from the most
+// recently published. Nothing is rendered if no visible post has the tag.
+func (app *App) renderBlogTag(ctx context.Context, w io.Writer, blog Blog, tag string, links siteLinks, isOwner bool) (found bool, err error) {
+	POST := sq.New[POST]("")
+	predicate := sq.And(
+		POST.BLOG_ID.EqUUID(blog.BlogID),
+		visiblePosts(POST),
+		postTagged(POST, tag),
+	)
+	posts, err := sq.FetchAllContext(ctx, app.DB, sq.
+		From(POST).
+		Where(predicate).
+		OrderBy(POST.PUBLISH_AT.Desc(), POST.POST_ID.Desc()).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) (post Post) {
+			row.UUIDField(&post.PostID, POST.POST_ID)
+			post.Blog = blog
+			post.Title = row.StringField(POST.TITLE)
+			post.Status = row.StringField(POST.STATUS)
+			post.PublishAt = row.TimeField(POST.PUBLISH_AT)
+			post.Slug = row.StringField(POST.SLUG)
+			return post
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	if len(posts) == 0 {
+		return false, nil
+	}
+	err = app.fillPostTags(ctx, posts, predicate)
+	if err != nil {
+		return false, err
+	}
+	err = app.renderTheme(ctx, w, "tag", themeData{
+		Blog:    blog,
+		Title:   tag + " - " + blog.Title,
+		Posts:   posts,
+		Tag:     tag,
+		IsOwner: isOwner,
+		Links:   links,
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
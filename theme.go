@@ -0,0 +1,824 @@
+package notebrew
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"strings"
+	"text/template/parse"
+	"time"
+
+	"github.com/bokwoon95/sq"
+	"github.com/oklog/ulid/v2"
+)
+
+// themeTemplates are the names of the templates that make up the theme of a
+// blog. Every page of a blog is rendered with the layout template, which
+// includes the template of the page (index, post or tag) with
+// {{ template "content" . }}. The default theme is in html/theme.
+var themeTemplates = []string{"layout", "index", "post", "tag"}
+
+// maxThemeTemplateSize is the maximum size of a theme template in bytes,
+// matching the length of BLOG_TEMPLATE.BODY.
+const maxThemeTemplateSize = 65536
+
+// maxThemeOutputSize is the maximum size of a page rendered with a theme that
+// the owner of a blog has changed, so that a runaway template can't exhaust
+// the memory of the server.
+const maxThemeOutputSize = 8 << 20
+
+var errThemeOutputTooLarge = fmt.Errorf("theme rendered a page larger than %s", formatBytes(maxThemeOutputSize))
+
+// maxThemeExecutionTime is how long a theme that the owner of a blog has
+// changed may take to render a page, so that a runaway template can't tie up
+// the server either.
+const maxThemeExecutionTime = time.Second
+
+var errThemeTimeout = fmt.Errorf("theme took longer than %s to render a page", maxThemeExecutionTime)
+
+// maxThemeRenders is the maximum number of pages being rendered with themes
+// that the owners of blogs have changed at once. A template that runs out of
+// time keeps running until it finishes or next writes to the page, so this
+// keeps such templates from piling up.
+const maxThemeRenders = 32
+
+// themeRenders holds a value for every page being rendered with a theme that
+// the owner of a blog has changed, see maxThemeRenders.
+var themeRenders = make(chan struct{}, maxThemeRenders)
+
+// maxThemeRangeDepth is how deeply the range actions of a theme may be
+// nested. Every range is over the data of the page, but nesting them deeply
+// enough still multiplies into a loop that never ends.
+const maxThemeRangeDepth = 2
+
+// themeNumberFuncs are the functions that themes may pass numbers to. None of
+// them return a number that a range could then loop over, unlike and and or.
+var themeNumberFuncs = map[string]bool{
+	"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true,
+	"index": true, "slice": true, "print": true, "printf": true, "println": true,
+}
+
+// themeContentSecurityPolicy is sent with every page rendered with a blog's
+// theme, so that a script that slips past checkThemeHTML still can't run on
+// the app's origin. Everything but images comes from the app itself, except
+// for hCaptcha, since the comment form needs it (which also rules out
+// sandboxing the page, as that would block the form). Forms can only be
+// submitted to the app, so a theme can't pose as its login page either.
+const themeContentSecurityPolicy = "default-src 'self'; " +
+	"script-src https://hcaptcha.com https://*.hcaptcha.com; " +
+	"frame-src https://hcaptcha.com https://*.hcaptcha.com; " +
+	"style-src 'self' 'unsafe-inline' https://hcaptcha.com https://*.hcaptcha.com; " +
+	"connect-src 'self' https://hcaptcha.com https://*.hcaptcha.com; " +
+	"img-src * data:; form-action 'self'; object-src 'none'; base-uri 'none'"
+
+// setThemeHeaders sets the headers of a page rendered with a blog's theme.
+func setThemeHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", themeContentSecurityPolicy)
+}
+
+// themeData is the data that every template of a theme is executed with.
+type themeData struct {
+	Blog Blog
+	// Title is the title of the page.
+	Title string
+	// Posts are the visible posts listed by the index and tag pages.
+	Posts []Post
+	// Drafts are the drafts and scheduled posts listed by the index page,
+	// only for the owner of the blog.
+	Drafts []Post
+	// Post is the post shown by the post page.
+	Post Post
+	// Tag is the tag whose posts are listed by the tag page.
+	Tag string
+	// Comments are the approved comments on the post shown by the post
+	// page, oldest first.
+	Comments []Comment
+	// CommentForm is the form for commenting on the post shown by the post
+	// page, or nil if it can't be commented on (such as when the blog has
+	// comments turned off, or in a static export).
+	CommentForm *commentForm
+	// PendingComments is the number of comments waiting for approval, only
+	// for the owner of the blog on the index page.
+	PendingComments int
+	IsOwner         bool
+	Links           siteLinks
+	// ThemeError is why the theme of the blog failed, if the page fell
+	// back to the default theme. It is only shown to the owner of the
+	// blog.
+	ThemeError string
+}
+
+// defaultTheme returns the templates of the default theme by name.
+func defaultTheme() (map[string]string, error) {
+	theme := make(map[string]string)
+	for _, name := range themeTemplates {
+		b, err := fs.ReadFile(rootFS, "html/theme/"+name+".html")
+		if err != nil {
+			return nil, err
+		}
+		theme[name] = string(b)
+	}
+	return theme, nil
+}
+
+// customTemplates returns the templates of a blog's theme that its owner has
+// changed from the default theme, by name.
+func (app *App) customTemplates(ctx context.Context, blogID ulid.ULID) (map[string]string, error) {
+	BLOG_TEMPLATE := sq.New[BLOG_TEMPLATE]("")
+	custom := make(map[string]string)
+	cursor, err := sq.FetchCursorContext(ctx, app.DB, sq.
+		From(BLOG_TEMPLATE).
+		Where(BLOG_TEMPLATE.BLOG_ID.EqUUID(blogID)).
+		SetDialect(app.Dialect),
+		func(row *sq.Row) [2]string {
+			return [2]string{row.StringField(BLOG_TEMPLATE.NAME), row.StringField(BLOG_TEMPLATE.BODY)}
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	for cursor.Next() {
+		result, err := cursor.Result()
+		if err != nil {
+			return nil, err
+		}
+		custom[result[0]] = result[1]
+	}
+	return custom, cursor.Close()
+}
+
+// parseTheme parses the layout template of a theme along with the template
+// of a page, which the layout includes as "content".
+func parseTheme(theme map[string]string, page string) (*template.Template, error) {
+	tmpl, err := template.New("layout").Parse(theme["layout"])
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmpl.New(page).Parse(theme[page])
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmpl.New("content").Parse(`{{ template "` + page + `" . }}`)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// executeTheme renders a page of a blog with a theme.
+func executeTheme(w io.Writer, theme map[string]string, page string, data themeData) error {
+	tmpl, err := parseTheme(theme, page)
+	if err != nil {
+		return err
+	}
+	return tmpl.ExecuteTemplate(w, "layout", data)
+}
+
+// executeCustomTheme renders a page of a blog with a theme that its owner has
+// changed, limiting the size of the page to maxThemeOutputSize and the time
+// taken to maxThemeExecutionTime. Templates can't be interrupted, so a
+// template that runs out of time is left running in the background until it
+// next writes to the page (or finishes), and the page is discarded. The
+// templates must pass checkThemeLoops, which keeps them from looping without
+// end, and at most maxThemeRenders of them run at once.
+func executeCustomTheme(ctx context.Context, theme map[string]string, page string, data themeData) (*limitedBuffer, error) {
+	err := checkThemeLoops(theme)
+	if err != nil {
+		return nil, err
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, maxThemeExecutionTime)
+	defer cancel()
+	select {
+	case themeRenders <- struct{}{}:
+	case <-timeoutCtx.Done():
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errThemeTimeout
+	}
+	buf := &limitedBuffer{limit: maxThemeOutputSize, ctx: timeoutCtx}
+	errc := make(chan error, 1)
+	go func() {
+		defer func() { <-themeRenders }()
+		errc <- executeTheme(buf, theme, page, data)
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	case <-timeoutCtx.Done():
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errThemeTimeout
+	}
+}
+
+// renderTheme renders a page of a blog (index, post or tag) with the theme of
+// the blog. If the theme fails, the page is rendered with the default theme
+// instead so that the blog stays readable, and the owner of the blog is shown
+// why.
+func (app *App) renderTheme(ctx context.Context, w io.Writer, page string, data themeData) error {
+	theme, err := defaultTheme()
+	if err != nil {
+		return err
+	}
+	custom, err := app.customTemplates(ctx, data.Blog.BlogID)
+	if err != nil {
+		return err
+	}
+	if custom["layout"] != "" || custom[page] != "" {
+		for name, body := range custom {
+			theme[name] = body
+		}
+		buf, err := executeCustomTheme(ctx, theme, page, data)
+		if err == nil {
+			// The templates were checked when they were saved, but the
+			// markup they produce also depends on the data.
+			err = checkThemeHTML(buf.String())
+		}
+		if err == nil {
+			_, err = buf.WriteTo(w)
+			return err
+		}
+		log.Printf("blog %s: %v", data.Blog.BlogIDString(), err)
+		if data.IsOwner {
+			data.ThemeError = err.Error()
+		}
+		theme, err = defaultTheme()
+		if err != nil {
+			return err
+		}
+	}
+	return executeTheme(w, theme, page, data)
+}
+
+// limitedBuffer is a bytes.Buffer that fails writes past its limit, or once
+// its context is done.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+	ctx   context.Context
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.ctx != nil && b.ctx.Err() != nil {
+		return 0, b.ctx.Err()
+	}
+	if b.Len()+len(p) > b.limit {
+		return 0, errThemeOutputTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+// checkTheme checks that every page of a theme renders, with an example post
+// standing in for the posts of the blog. Templates that only parse can still
+// fail when executed, such as when html/template can't escape them. The
+// templates and the pages they render must not contain scripts, see
+// checkThemeHTML.
+func checkTheme(ctx context.Context, theme map[string]string, blog Blog) error {
+	// The text of every branch of a template is checked, not just those
+	// taken when rendering the example pages.
+	for _, name := range themeTemplates {
+		tmpl, err := template.New(name).Parse(theme[name])
+		if err != nil {
+			return err
+		}
+		for _, t := range tmpl.Templates() {
+			if t.Tree == nil {
+				continue
+			}
+			var b strings.Builder
+			templateText(&b, t.Tree.Root)
+			err = checkThemeHTML(b.String())
+			if err != nil {
+				return fmt.Errorf("%s template: %w", name, err)
+			}
+		}
+	}
+	post := Post{
+		PostID:    ulid.Make(),
+		Blog:      blog,
+		Title:     "Example post",
+		Body:      "This is an example post.",
+		Status:    postPublished,
+		PublishAt: time.Now().UTC(),
+		Slug:      "example-post",
+		Tags:      []string{"example"},
+	}
+	comment := Comment{
+		CommentID: ulid.Make(),
+		Post:      post,
+		Name:      "Example reader",
+		Body:      "This is an example comment.",
+		Status:    commentApproved,
+	}
+	data := themeData{
+		Blog:            blog,
+		Title:           blog.Title,
+		Posts:           []Post{post},
+		Post:            post,
+		Tag:             "example",
+		Comments:        []Comment{comment},
+		CommentForm:     &commentForm{PostID: post.PostIDString(), HCaptchaSiteKey: "example"},
+		PendingComments: 1,
+		Links:           siteLinks{BlogID: blog.BlogIDString()},
+	}
+	// Every template but the layout is a page.
+	for _, page := range themeTemplates[1:] {
+		buf, err := executeCustomTheme(ctx, theme, page, data)
+		if err != nil {
+			return err
+		}
+		err = checkThemeHTML(buf.String())
+		if err != nil {
+			return fmt.Errorf("%s page: %w", page, err)
+		}
+	}
+	return nil
+}
+
+// checkThemeLoops checks that the templates of a theme can't loop without end
+// or for long enough to tie up the server, since a template that doesn't write
+// to the page can't be stopped once it runs out of time. Templates can only
+// range over the fields of the data (or variables and dot holding them), as
+// numbers can be ranged over as well, and can't nest ranges more than
+// maxThemeRangeDepth deep. Numbers may only be passed to themeNumberFuncs, so
+// that they can't end up in a variable or dot either. Templates can't define
+// templates of their own or include any but the layout including "content",
+// which rules out recursion.
+func checkThemeLoops(theme map[string]string) error {
+	for _, name := range themeTemplates {
+		tmpl, err := template.New(name).Parse(theme[name])
+		if err != nil {
+			return err
+		}
+		if len(tmpl.Templates()) > 1 {
+			return fmt.Errorf("%s template: themes can't define templates", name)
+		}
+		if tmpl.Tree == nil {
+			continue
+		}
+		err = checkThemeNode(name, tmpl.Tree.Root, 0)
+		if err != nil {
+			return fmt.Errorf("%s template: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// checkThemeNode checks a node of the template of a theme for checkThemeLoops.
+// rangeDepth is the number of range actions the node is nested in.
+func checkThemeNode(name string, node parse.Node, rangeDepth int) error {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, node := range node.Nodes {
+			err := checkThemeNode(name, node, rangeDepth)
+			if err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return checkThemePipe(node.Pipe)
+	case *parse.IfNode:
+		return checkThemeBranch(name, &node.BranchNode, rangeDepth)
+	case *parse.WithNode:
+		return checkThemeBranch(name, &node.BranchNode, rangeDepth)
+	case *parse.RangeNode:
+		if rangeDepth >= maxThemeRangeDepth {
+			return fmt.Errorf("themes can't nest range more than %d deep", maxThemeRangeDepth)
+		}
+		var ok bool
+		if cmds := node.Pipe.Cmds; len(cmds) == 1 && len(cmds[0].Args) == 1 {
+			switch cmds[0].Args[0].(type) {
+			case *parse.FieldNode, *parse.VariableNode, *parse.DotNode:
+				ok = true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: themes can only range over fields and variables", node.Pipe)
+		}
+		err := checkThemePipe(node.Pipe)
+		if err != nil {
+			return err
+		}
+		err = checkThemeNode(name, node.List, rangeDepth+1)
+		if err != nil {
+			return err
+		}
+		return checkThemeNode(name, node.ElseList, rangeDepth)
+	case *parse.TemplateNode:
+		if name != "layout" || node.Name != "content" || rangeDepth > 0 {
+			return fmt.Errorf("%s: themes can only include \"content\", once per layout", node)
+		}
+		return checkThemePipe(node.Pipe)
+	}
+	return nil
+}
+
+// checkThemeBranch checks an if or with action for checkThemeNode.
+func checkThemeBranch(name string, node *parse.BranchNode, rangeDepth int) error {
+	err := checkThemePipe(node.Pipe)
+	if err != nil {
+		return err
+	}
+	err = checkThemeNode(name, node.List, rangeDepth)
+	if err != nil {
+		return err
+	}
+	return checkThemeNode(name, node.ElseList, rangeDepth)
+}
+
+// checkThemePipe checks that a pipeline of the template of a theme only
+// passes numbers to themeNumberFuncs.
+func checkThemePipe(pipe *parse.PipeNode) error {
+	if pipe == nil {
+		return nil
+	}
+	for _, cmd := range pipe.Cmds {
+		var numbersAllowed bool
+		if len(cmd.Args) > 0 {
+			if ident, ok := cmd.Args[0].(*parse.IdentifierNode); ok {
+				numbersAllowed = themeNumberFuncs[ident.Ident]
+			}
+		}
+		for i, arg := range cmd.Args {
+			switch arg := arg.(type) {
+			case *parse.NumberNode:
+				if i == 0 || !numbersAllowed {
+					return fmt.Errorf("%s: themes can only pass numbers to comparisons, index, slice and print", cmd)
+				}
+			case *parse.PipeNode:
+				err := checkThemePipe(arg)
+				if err != nil {
+					return err
+				}
+			case *parse.ChainNode:
+				if pipe, ok := arg.Node.(*parse.PipeNode); ok {
+					err := checkThemePipe(pipe)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// templateText writes the text of a template outside of its actions to b,
+// including the text of every branch of its if, range and with actions.
+func templateText(b *strings.Builder, node parse.Node) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, node := range node.Nodes {
+			templateText(b, node)
+		}
+	case *parse.TextNode:
+		b.Write(node.Text)
+	case *parse.IfNode:
+		templateText(b, node.List)
+		templateText(b, node.ElseList)
+	case *parse.RangeNode:
+		templateText(b, node.List)
+		templateText(b, node.ElseList)
+	case *parse.WithNode:
+		templateText(b, node.List)
+		templateText(b, node.ElseList)
+	}
+}
+
+// themeScriptError is returned by checkThemeHTML for markup that could run a
+// script.
+type themeScriptError struct {
+	What string
+}
+
+func (e *themeScriptError) Error() string {
+	return "themes can't contain " + e.What
+}
+
+// themeForbiddenElements are the elements that themes can't contain, because
+// they can run scripts or change where the page's links and forms lead.
+var themeForbiddenElements = map[string]bool{
+	"script":   true,
+	"iframe":   true,
+	"frame":    true,
+	"frameset": true,
+	"object":   true,
+	"embed":    true,
+	"applet":   true,
+	"base":     true,
+}
+
+// themeRawTextElements are the elements whose contents are not markup.
+var themeRawTextElements = map[string]bool{
+	"style":    true,
+	"textarea": true,
+	"title":    true,
+	"xmp":      true,
+}
+
+// checkThemeHTML checks that the HTML (or the text of the templates) of a
+// theme can't run scripts: it must not contain script elements other than
+// hCaptcha's, other elements that can embed or run scripts, event handler
+// attributes or javascript: URLs.
+func checkThemeHTML(s string) error {
+	for i := 0; i < len(s); {
+		j := strings.IndexByte(s[i:], '<')
+		if j < 0 {
+			return nil
+		}
+		i += j + 1
+		if strings.HasPrefix(s[i:], "!--") {
+			end := strings.Index(s[i+3:], "-->")
+			if end < 0 {
+				return nil
+			}
+			i += 3 + end + 3
+			continue
+		}
+		if i < len(s) && s[i] == '/' {
+			i++
+		}
+		if i >= len(s) || !isASCIILetter(s[i]) {
+			continue
+		}
+		start := i
+		for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '/' && s[i] != '>' {
+			i++
+		}
+		closing := s[start-1] == '/'
+		tag := strings.ToLower(s[start:i])
+		attrs := make(map[string]string)
+		for i < len(s) && s[i] != '>' {
+			if isHTMLSpace(s[i]) || s[i] == '/' {
+				i++
+				continue
+			}
+			start := i
+			i++
+			for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '/' && s[i] != '>' && s[i] != '=' {
+				i++
+			}
+			name := strings.ToLower(s[start:i])
+			for i < len(s) && isHTMLSpace(s[i]) {
+				i++
+			}
+			var value string
+			if i < len(s) && s[i] == '=' {
+				i++
+				for i < len(s) && isHTMLSpace(s[i]) {
+					i++
+				}
+				if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+					quote := s[i]
+					end := strings.IndexByte(s[i+1:], quote)
+					if end < 0 {
+						end = len(s) - i - 1
+					}
+					value = s[i+1 : i+1+end]
+					i += 1 + end + 1
+				} else {
+					start := i
+					for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '>' {
+						i++
+					}
+					value = s[start:i]
+				}
+			}
+			if strings.HasPrefix(name, "on") {
+				return &themeScriptError{What: "event handler attributes (" + name + ")"}
+			}
+			if hasScriptScheme(value) {
+				return &themeScriptError{What: "javascript: URLs"}
+			}
+			attrs[name] = value
+		}
+		if closing {
+			continue
+		}
+		if tag == "script" && strings.HasPrefix(html.UnescapeString(attrs["src"]), "https://js.hcaptcha.com/") {
+			continue
+		}
+		if themeForbiddenElements[tag] {
+			return &themeScriptError{What: "<" + tag + "> elements"}
+		}
+		if _, ok := attrs["http-equiv"]; ok && tag == "meta" {
+			return &themeScriptError{What: "<meta http-equiv> elements"}
+		}
+		if themeRawTextElements[tag] {
+			end := strings.Index(strings.ToLower(s[i:]), "</"+tag)
+			if end < 0 {
+				return nil
+			}
+			i += end
+		}
+	}
+	return nil
+}
+
+// hasScriptScheme reports whether an attribute value is a URL that runs a
+// script when followed, taking into account that browsers decode character
+// references in attribute values and ignore whitespace and control
+// characters in URLs.
+func hasScriptScheme(value string) bool {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, html.UnescapeString(value))
+	value = strings.ToLower(value)
+	return strings.HasPrefix(value, "javascript:") || strings.HasPrefix(value, "vbscript:")
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// themeEditor renders the form for editing the templates of a blog's theme.
+// theme holds the templates to show in place of the current ones, if the
+// form is being shown again because they couldn't be saved.
+func (app *App) themeEditor(w http.ResponseWriter, r *http.Request, code int, blog Blog, theme map[string]string, themeErr error) {
+	type Template struct {
+		Name   string
+		Body   string
+		Custom bool
+	}
+	type TemplateData struct {
+		Blog      Blog
+		Templates []Template
+		Error     string
+	}
+
+	defaults, err := defaultTheme()
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if theme == nil {
+		theme, err = app.customTemplates(r.Context(), blog.BlogID)
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	templateData := TemplateData{Blog: blog}
+	if themeErr != nil {
+		templateData.Error = themeErr.Error()
+	}
+	for _, name := range themeTemplates {
+		body, custom := theme[name]
+		if !custom {
+			body = defaults[name]
+		}
+		templateData.Templates = append(templateData.Templates, Template{
+			Name:   name,
+			Body:   body,
+			Custom: custom,
+		})
+	}
+	tmpl, err := template.ParseFiles("html/edit_theme.html")
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, templateData)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(code)
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// saveTheme saves the templates of a blog's theme submitted from the theme
+// editor, either typed into the form or uploaded as files. Templates that are
+// left empty or are the same as the default template are reset to the
+// default. Nothing is saved unless every page of the resulting theme renders.
+func (app *App) saveTheme(w http.ResponseWriter, r *http.Request, blog Blog) {
+	// Leave room for the form encoding of every template.
+	r.Body = http.MaxBytesReader(w, r.Body, int64(len(themeTemplates))*4*maxThemeTemplateSize)
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			app.Error(w, r, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		app.Error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	defaults, err := defaultTheme()
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	custom := make(map[string]string)
+	for _, name := range themeTemplates {
+		body := r.PostForm.Get(name)
+		file, _, err := r.FormFile(name + "_file")
+		if err == nil {
+			b, err := io.ReadAll(io.LimitReader(file, maxThemeTemplateSize+1))
+			file.Close()
+			if err != nil {
+				app.Error(w, r, http.StatusBadRequest, err)
+				return
+			}
+			if len(b) > 0 {
+				body = string(b)
+			}
+		}
+		// Browsers submit textareas with CRLF line endings.
+		body = strings.ReplaceAll(body, "\r\n", "\n")
+		if strings.TrimSpace(body) == "" || body == defaults[name] {
+			continue
+		}
+		custom[name] = body
+	}
+	theme := make(map[string]string)
+	for _, name := range themeTemplates {
+		theme[name] = defaults[name]
+	}
+	for name, body := range custom {
+		if len(body) > maxThemeTemplateSize {
+			app.themeEditor(w, r, http.StatusRequestEntityTooLarge, blog, custom, fmt.Errorf("%s template is larger than %s", name, formatBytes(maxThemeTemplateSize)))
+			return
+		}
+		theme[name] = body
+	}
+	err = checkTheme(r.Context(), theme, blog)
+	if err != nil {
+		app.themeEditor(w, r, http.StatusBadRequest, blog, custom, err)
+		return
+	}
+	err = app.replaceCustomTemplates(r.Context(), blog.BlogID, custom)
+	if err != nil {
+		app.Error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	http.Redirect(w, r, "/blog/"+blog.BlogIDString()+"/", http.StatusFound)
+}
+
+// replaceCustomTemplates replaces the templates of a blog's theme that its
+// owner has changed from the default theme.
+func (app *App) replaceCustomTemplates(ctx context.Context, blogID ulid.ULID, custom map[string]string) error {
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	BLOG_TEMPLATE := sq.New[BLOG_TEMPLATE]("")
+	_, err = sq.ExecContext(ctx, tx, sq.
+		DeleteFrom(BLOG_TEMPLATE).
+		Where(BLOG_TEMPLATE.BLOG_ID.EqUUID(blogID)).
+		SetDialect(app.Dialect),
+	)
+	if err != nil {
+		return err
+	}
+	for _, name := range themeTemplates {
+		body, ok := custom[name]
+		if !ok {
+			continue
+		}
+		_, err = sq.ExecContext(ctx, tx, sq.
+			InsertInto(BLOG_TEMPLATE).
+			ColumnValues(func(col *sq.Column) {
+				col.SetUUID(BLOG_TEMPLATE.BLOG_ID, blogID)
+				col.SetString(BLOG_TEMPLATE.NAME, name)
+				col.SetString(BLOG_TEMPLATE.BODY, body)
+			}).
+			SetDialect(app.Dialect),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
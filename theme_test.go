@@ -0,0 +1,209 @@
+package notebrew
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestCheckThemeHTML(t *testing.T) {
+	type TestTable struct {
+		description string
+		html        string
+		wantOK      bool
+	}
+
+	tests := []TestTable{{
+		description: "plain markup",
+		html:        `<!DOCTYPE html><html><head><style>p > a { color: red }</style></head><body><a href="/post/">on=1</a></body></html>`,
+		wantOK:      true,
+	}, {
+		description: "hCaptcha script",
+		html:        `<div class="h-captcha"></div><script src="https://js.hcaptcha.com/1/api.js" async defer></script>`,
+		wantOK:      true,
+	}, {
+		description: "script in a comment",
+		html:        `<!-- <script>alert(1)</script> -->`,
+		wantOK:      true,
+	}, {
+		description: "script in a style",
+		html:        `<style>/* <script> */</style>`,
+		wantOK:      true,
+	}, {
+		description: "inline script",
+		html:        `<p>hi</p><SCRIPT>alert(1)</SCRIPT>`,
+	}, {
+		description: "script from elsewhere",
+		html:        `<script src="https://example.com/hcaptcha.js"></script>`,
+	}, {
+		description: "event handler",
+		html:        `<img src="x" onerror="alert(1)">`,
+	}, {
+		description: "unquoted event handler",
+		html:        `<body/onload=alert(1)>`,
+	}, {
+		description: "javascript URL",
+		html:        `<a href="javascript:alert(1)">x</a>`,
+	}, {
+		description: "obfuscated javascript URL",
+		html:        `<a href=" jav&#x61;&Tab;script&colon;alert(1)">x</a>`,
+	}, {
+		description: "iframe",
+		html:        `<iframe srcdoc="x"></iframe>`,
+	}, {
+		description: "base",
+		html:        `<base href="https://example.com/">`,
+	}, {
+		description: "meta refresh",
+		html:        `<meta http-equiv="refresh" content="0; url=https://example.com/">`,
+	}, {
+		description: "svg script",
+		html:        `<svg><script>alert(1)</script></svg>`,
+	}}
+
+	for _, tt := range tests {
+		err := checkThemeHTML(tt.html)
+		if tt.wantOK {
+			if err != nil {
+				t.Errorf("%s: %v", tt.description, err)
+			}
+			continue
+		}
+		var scriptErr *themeScriptError
+		if !errors.As(err, &scriptErr) {
+			t.Errorf("%s: got error %v, want a *themeScriptError", tt.description, err)
+		}
+	}
+}
+
+func TestCheckTheme(t *testing.T) {
+	blog := Blog{BlogID: ulid.Make(), Title: "Example blog"}
+
+	type TestTable struct {
+		description string
+		post        string
+		wantOK      bool
+	}
+
+	tests := []TestTable{{
+		description: "default theme",
+		wantOK:      true,
+	}, {
+		description: "script in a branch that isn't taken",
+		post:        `{{ if eq .Post.Title "x" }}<script>alert(1)</script>{{ end }}`,
+	}, {
+		description: "script tag split by an action",
+		post:        `<scr{{ "" }}ipt>alert(1)</script>`,
+	}, {
+		description: "tag name from the data is escaped",
+		post:        `<{{ .Post.Slug }}>`,
+		wantOK:      true,
+	}}
+
+	for _, tt := range tests {
+		theme, err := defaultTheme()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.post != "" {
+			theme["post"] = tt.post
+		}
+		err = checkTheme(context.Background(), theme, blog)
+		if tt.wantOK {
+			if err != nil {
+				t.Errorf("%s: %v", tt.description, err)
+			}
+			continue
+		}
+		var scriptErr *themeScriptError
+		if !errors.As(err, &scriptErr) {
+			t.Errorf("%s: got error %v, want a *themeScriptError", tt.description, err)
+		}
+	}
+}
+
+func TestCheckThemeLoops(t *testing.T) {
+	type TestTable struct {
+		description string
+		layout      string
+		post        string
+		wantOK      bool
+	}
+
+	tests := []TestTable{{
+		description: "default theme",
+		wantOK:      true,
+	}, {
+		description: "range over a field, a variable and dot",
+		post:        `{{ range $c := .Comments }}{{ range $.Post.Tags }}{{ . }}{{ end }}{{ end }}{{ with .Posts }}{{ range . }}{{ end }}{{ end }}`,
+		wantOK:      true,
+	}, {
+		description: "numbers passed to comparisons, index and printf",
+		post:        `{{ if gt (len .Posts) 5 }}{{ index .Posts 0 }}{{ printf "%d" 1 }}{{ end }}`,
+		wantOK:      true,
+	}, {
+		description: "range over a number",
+		post:        `{{ range 1000000000 }}{{ range 1000000000 }}{{ end }}{{ end }}`,
+	}, {
+		description: "range over a function result",
+		post:        `{{ range (or .Posts .Drafts) }}{{ end }}`,
+	}, {
+		description: "number in a variable",
+		post:        `{{ $n := 1000000000 }}{{ range $n }}{{ end }}`,
+	}, {
+		description: "number in dot",
+		post:        `{{ with or 1000000000 .Posts }}{{ range . }}{{ end }}{{ end }}`,
+	}, {
+		description: "ranges nested too deep",
+		post:        `{{ range .Posts }}{{ range $.Posts }}{{ range $.Posts }}{{ end }}{{ end }}{{ end }}`,
+	}, {
+		description: "template defined by the theme",
+		post:        `{{ define "t" }}{{ template "t" . }}{{ end }}`,
+	}, {
+		description: "page including a template",
+		post:        `{{ template "layout" . }}{{ template "layout" . }}`,
+	}, {
+		description: "layout including content in a range",
+		layout:      `{{ range .Posts }}{{ template "content" $ }}{{ end }}`,
+	}}
+
+	for _, tt := range tests {
+		theme, err := defaultTheme()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.layout != "" {
+			theme["layout"] = tt.layout
+		}
+		if tt.post != "" {
+			theme["post"] = tt.post
+		}
+		err = checkThemeLoops(theme)
+		if tt.wantOK {
+			if err != nil {
+				t.Errorf("%s: %v", tt.description, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.description)
+		}
+	}
+}
+
+func TestExecuteCustomThemeTimeout(t *testing.T) {
+	theme, err := defaultTheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ranging over every pair of posts without writing anything takes far
+	// longer than maxThemeExecutionTime.
+	theme["index"] = `{{ range .Posts }}{{ range $.Posts }}{{ end }}{{ end }}`
+	data := themeData{Posts: make([]Post, 20000)}
+	_, err = executeCustomTheme(context.Background(), theme, "index", data)
+	if !errors.Is(err, errThemeTimeout) {
+		t.Errorf("got error %v, want %v", err, errThemeTimeout)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/bokwoon95/sq"
@@ -15,10 +16,22 @@ import (
 )
 
 func (app *App) User(w http.ResponseWriter, r *http.Request) {
+	type Usage struct {
+		Used  string
+		Limit string
+		// Percent is how much of the limit has been used, or -1 if there
+		// is no limit.
+		Percent int
+	}
 	type TemplateData struct {
 		UserID        string
 		CurrentUserID string
 		Name          string
+		// Notes, NoteStorage and ImageStorage are only shown to the user
+		// themselves.
+		Notes        *Usage
+		NoteStorage  *Usage
+		ImageStorage *Usage
 	}
 
 	if r.Method != "GET" {
@@ -100,6 +113,25 @@ func (app *App) User(w http.ResponseWriter, r *http.Request) {
 		CurrentUserID: strings.ToLower(currentUserID.String()),
 		Name:          name,
 	}
+	if loggedIn && currentUserID == userID {
+		usage, quota, err := app.userQuota(r.Context(), app.DB, userID, false)
+		if err != nil {
+			app.Error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		newUsage := func(used, limit int64, format func(int64) string) *Usage {
+			u := &Usage{Used: format(used), Percent: -1}
+			if limit > 0 {
+				u.Limit = format(limit)
+				u.Percent = int(used * 100 / limit)
+			}
+			return u
+		}
+		formatInt := func(n int64) string { return strconv.FormatInt(n, 10) }
+		templateData.Notes = newUsage(usage.Notes, quota.Notes, formatInt)
+		templateData.NoteStorage = newUsage(usage.NoteBytes, quota.NoteBytes, formatBytes)
+		templateData.ImageStorage = newUsage(usage.ImageBytes, quota.ImageBytes, formatBytes)
+	}
 	tmpl, err := template.ParseFiles("html/user.html")
 	if err != nil {
 		app.Error(w, r, http.StatusInternalServerError, err)